@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jsonConfig is a configuration file compatible with config.json of shadowsocks-libev,
+// plus a few extensions for the modes of this program.
+type jsonConfig struct {
+	Server       string   `json:"server"`
+	ServerPort   int      `json:"server_port"`
+	LocalAddress string   `json:"local_address"`
+	LocalPort    int      `json:"local_port"`
+	Password     string   `json:"password"`
+	Key          string   `json:"key"` // standard base64 as in shadowsocks-libev
+	Method       string   `json:"method"`
+	Plugin       string   `json:"plugin"`
+	PluginOpts   string   `json:"plugin_opts"`
+	Mode         string   `json:"mode"`    // tcp_only, udp_only or tcp_and_udp
+	Timeout      int      `json:"timeout"` // UDP session timeout in seconds
+	Tunnels      []string `json:"tunnels"` // laddr=raddr tunnels for TCP and/or UDP depending on mode
+
+	// extensions
+	HTTP          string       `json:"http"`
+	Mixed         string       `json:"mixed"`
+	Auth          []string     `json:"auth"`
+	AuthFile      string       `json:"auth_file"`
+	Redir         string       `json:"redir"`
+	Redir6        string       `json:"redir6"`
+	RedirUDP      string       `json:"redir_udp"`
+	TProxy        string       `json:"tproxy"`
+	TCPTun        []string     `json:"tcptun"`
+	UDPTun        []string     `json:"udptun"`
+	Users         []jsonUser   `json:"users"`
+	Servers       []jsonServer `json:"servers"` // client servers in addition to server and server_port
+	Policy        string       `json:"policy"`
+	Probe         string       `json:"probe"`
+	ProbeInterval int          `json:"probe_interval"` // seconds
+	Rules         string       `json:"rules"`
+	ACL           string       `json:"acl"`
+	GeoIP         string       `json:"geoip"`
+	Geosite       string       `json:"geosite"`
+	Verbose       bool         `json:"verbose"`
+	TCPCork       bool         `json:"tcpcork"`
+	SocksDefer    bool         `json:"socks_defer"`
+	Bind          bool         `json:"bind"`
+	BindAddr      string       `json:"bind_addr"`
+	Sniff         bool         `json:"sniff"`
+
+	// DNS forwarder
+	DNS              string   `json:"dns"`
+	DNSUpstream      string   `json:"dns_upstream"`
+	DNSTCP           bool     `json:"dns_tcp"`
+	DNSDirect        string   `json:"dns_direct"`
+	DNSDirectDomains []string `json:"dns_direct_domains"`
+	FakeIP           string   `json:"fake_ip"`
+	FakeIPFile       string   `json:"fake_ip_file"`
+
+	// server resolver
+	Resolver       []string `json:"resolver"`
+	ResolverHosts  string   `json:"resolver_hosts"`
+	ResolverPrefer string   `json:"resolver_prefer"`
+}
+
+// jsonServer is a client server, with the method, password and plugin of the top level
+// configuration if empty.
+type jsonServer struct {
+	Server     string `json:"server"`
+	ServerPort int    `json:"server_port"`
+	Method     string `json:"method"`
+	Password   string `json:"password"`
+	Plugin     string `json:"plugin"`
+	PluginOpts string `json:"plugin_opts"`
+}
+
+// url returns s as an ss:// URL.
+func (s *jsonServer) url(cfg *jsonConfig) string {
+	method, password := s.Method, s.Password
+	if method == "" {
+		method = cfg.Method
+	}
+	if password == "" {
+		password = cfg.Password
+	}
+	u := &url.URL{
+		Scheme: "ss",
+		User:   url.UserPassword(method, password),
+		Host:   net.JoinHostPort(s.Server, strconv.Itoa(s.ServerPort)),
+	}
+	plugin, opts := s.Plugin, s.PluginOpts
+	if plugin == "" {
+		plugin, opts = cfg.Plugin, cfg.PluginOpts
+	}
+	if plugin != "" {
+		if opts != "" {
+			plugin += ";" + opts
+		}
+		u.RawQuery = url.Values{"plugin": {plugin}}.Encode()
+	}
+	return u.String()
+}
+
+type jsonUser struct {
+	Name     string `json:"name"`
+	Method   string `json:"method"`
+	Password string `json:"password"`
+}
+
+func readConfig(path string) (*jsonConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cfg jsonConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("config %s: %v", path, err)
+	}
+	switch cfg.Mode {
+	case "", "tcp_only", "udp_only", "tcp_and_udp":
+	default:
+		return nil, fmt.Errorf("config %s: invalid mode %q: want tcp_only, udp_only or tcp_and_udp", path, cfg.Mode)
+	}
+	if cfg.Server != "" && cfg.ServerPort == 0 {
+		return nil, fmt.Errorf("config %s: missing server_port", path)
+	}
+	for _, tuns := range [][]string{cfg.Tunnels, cfg.TCPTun, cfg.UDPTun} {
+		for _, tun := range tuns {
+			if len(strings.Split(tun, "=")) != 2 {
+				return nil, fmt.Errorf("config %s: invalid tunnel %q: want laddr=raddr", path, tun)
+			}
+		}
+	}
+	for i, srv := range cfg.Servers {
+		if srv.Server == "" || srv.ServerPort == 0 {
+			return nil, fmt.Errorf("config %s: servers[%d]: server and server_port required", path, i)
+		}
+	}
+	for i, u := range cfg.Users {
+		if u.Name == "" || u.Method == "" {
+			return nil, fmt.Errorf("config %s: users[%d]: name and method required", path, i)
+		}
+	}
+	return &cfg, nil
+}
+
+// isClient reports whether cfg configures any client-side listener or servers to connect to.
+func (cfg *jsonConfig) isClient() bool {
+	return cfg.LocalPort != 0 || cfg.HTTP != "" || cfg.Mixed != "" || cfg.Redir != "" || cfg.Redir6 != "" ||
+		cfg.RedirUDP != "" || cfg.TProxy != "" || cfg.DNS != "" || len(cfg.Tunnels) > 0 || len(cfg.TCPTun) > 0 || len(cfg.UDPTun) > 0 ||
+		len(cfg.Servers) > 0
+}
+
+// loadConfig reads the JSON configuration file at path into o and c,
+// except for values given on the command line.
+func loadConfig(path string, o *options, c *globalConfig) error {
+	cfg, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	fill := func(name string, ok bool, fn func()) {
+		if ok && !set[name] {
+			fn()
+		}
+	}
+
+	client := cfg.isClient()
+	if set["c"] || set["s"] {
+		client = set["c"]
+	}
+	tcp := cfg.Mode != "udp_only"
+	udp := cfg.Mode == "udp_only" || cfg.Mode == "tcp_and_udp"
+
+	if cfg.Server != "" {
+		addr := net.JoinHostPort(cfg.Server, strconv.Itoa(cfg.ServerPort))
+		if client {
+			fill("c", true, func() { o.Client = stringsFlag{addr} })
+		} else {
+			fill("s", true, func() { o.Server = addr })
+		}
+	}
+	fill("cipher", cfg.Method != "", func() { o.Cipher = cfg.Method })
+	fill("password", cfg.Password != "", func() { o.Password = cfg.Password })
+	if cfg.Key != "" && !set["key"] {
+		key, err := base64.StdEncoding.DecodeString(cfg.Key)
+		if err != nil {
+			return fmt.Errorf("config %s: key: %v", path, err)
+		}
+		o.Key = base64.URLEncoding.EncodeToString(key)
+	}
+	fill("plugin", cfg.Plugin != "", func() { o.Plugin = cfg.Plugin })
+	fill("plugin-opts", cfg.PluginOpts != "", func() { o.PluginOpts = cfg.PluginOpts })
+	fill("udptimeout", cfg.Timeout > 0, func() { c.UDPTimeout = time.Duration(cfg.Timeout) * time.Second })
+	fill("verbose", cfg.Verbose, func() { c.Verbose = true })
+	fill("tcpcork", cfg.TCPCork, func() { c.TCPCork = true })
+	fill("socks-defer", cfg.SocksDefer, func() { c.SocksDefer = true })
+	fill("bind", cfg.Bind, func() { c.Bind = true })
+	fill("bind-addr", cfg.BindAddr != "", func() { c.BindAddr = cfg.BindAddr })
+	fill("sniff", cfg.Sniff, func() { c.Sniff = true })
+	fill("fake-ip", cfg.FakeIP != "", func() { c.FakeIP = cfg.FakeIP })
+	fill("fake-ip-file", cfg.FakeIPFile != "", func() { c.FakeIPFile = cfg.FakeIPFile })
+
+	// server-only
+	fill("tcp", cfg.Mode != "", func() { o.TCP = tcp })
+	fill("udp", cfg.Mode != "", func() { o.UDP = udp })
+	fill("acl", cfg.ACL != "", func() { o.ACL = cfg.ACL })
+	fill("resolver", len(cfg.Resolver) > 0, func() { o.Resolver = strings.Join(cfg.Resolver, ",") })
+	fill("resolver-hosts", cfg.ResolverHosts != "", func() { o.ResolverHosts = cfg.ResolverHosts })
+	fill("resolver-prefer", cfg.ResolverPrefer != "", func() { o.ResolverPrefer = cfg.ResolverPrefer })
+	if len(cfg.Users) > 0 && !set["user"] {
+		for _, u := range cfg.Users {
+			o.Users = append(o.Users, u.Name+":"+u.Method+":"+u.Password)
+		}
+	}
+
+	// client-only
+	if cfg.LocalPort != 0 {
+		host := cfg.LocalAddress
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		fill("socks", true, func() { o.Socks = net.JoinHostPort(host, strconv.Itoa(cfg.LocalPort)) })
+		fill("u", udp, func() { o.UDPSocks = true })
+	}
+	if len(cfg.Servers) > 0 && !set["c"] {
+		for _, srv := range cfg.Servers {
+			o.Client = append(o.Client, srv.url(cfg))
+		}
+	}
+	fill("policy", cfg.Policy != "", func() { o.Policy = cfg.Policy })
+	fill("probe", cfg.Probe != "", func() { o.Probe = cfg.Probe })
+	fill("probe-interval", cfg.ProbeInterval > 0, func() { o.ProbeInterval = time.Duration(cfg.ProbeInterval) * time.Second })
+	fill("rules", cfg.Rules != "", func() { o.Rules = cfg.Rules })
+	fill("geoip", cfg.GeoIP != "", func() { o.GeoIP = cfg.GeoIP })
+	fill("geosite", cfg.Geosite != "", func() { o.Geosite = cfg.Geosite })
+	fill("http", cfg.HTTP != "", func() { o.HTTP = cfg.HTTP })
+	if cfg.Mixed != "" {
+		fill("mixed", true, func() { o.Mixed = cfg.Mixed })
+		fill("u", udp, func() { o.UDPSocks = true })
+	}
+	fill("auth", len(cfg.Auth) > 0, func() { o.Auth = cfg.Auth })
+	fill("auth-file", cfg.AuthFile != "", func() { o.AuthFile = cfg.AuthFile })
+	fill("redir", cfg.Redir != "", func() { o.RedirTCP = cfg.Redir })
+	fill("redir6", cfg.Redir6 != "", func() { o.RedirTCP6 = cfg.Redir6 })
+	fill("redir-udp", cfg.RedirUDP != "", func() { o.RedirUDP = cfg.RedirUDP })
+	fill("tproxy", cfg.TProxy != "", func() { o.TProxy = cfg.TProxy })
+	fill("dns", cfg.DNS != "", func() { o.DNS = cfg.DNS })
+	fill("dns-upstream", cfg.DNSUpstream != "", func() { o.DNSUpstream = cfg.DNSUpstream })
+	fill("dns-tcp", cfg.DNSTCP, func() { o.DNSTCP = true })
+	fill("dns-direct", cfg.DNSDirect != "", func() { o.DNSDirect = cfg.DNSDirect })
+	fill("dns-direct-domains", len(cfg.DNSDirectDomains) > 0, func() { o.DNSDirectDomains = strings.Join(cfg.DNSDirectDomains, ",") })
+	tcpTun, udpTun := cfg.TCPTun, cfg.UDPTun
+	if tcp {
+		tcpTun = append(tcpTun, cfg.Tunnels...)
+	}
+	if udp {
+		udpTun = append(udpTun, cfg.Tunnels...)
+	}
+	fill("tcptun", len(tcpTun) > 0, func() { o.TCPTun = strings.Join(tcpTun, ",") })
+	fill("udptun", len(udpTun) > 0, func() { o.UDPTun = strings.Join(udpTun, ",") })
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+)
+
+// writeConfig writes a configuration file and returns its path.
+func writeConfig(t *testing.T, s string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(s), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setFlags marks the flags of the given names as given on the command line for loadConfig.
+func setFlags(t *testing.T, names ...string) {
+	cmdline := flag.CommandLine
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, name := range names {
+		flag.String(name, "", "")
+		flag.Set(name, "")
+	}
+	t.Cleanup(func() { flag.CommandLine = cmdline })
+}
+
+func TestLoadConfigFlags(t *testing.T) {
+	path := writeConfig(t, `{
+		"server": "example.com", "server_port": 8488, "local_port": 1080,
+		"method": "AEAD_AES_128_GCM", "password": "file-password", "timeout": 60, "verbose": true
+	}`)
+
+	setFlags(t)
+	var o options
+	var c globalConfig
+	if err := loadConfig(path, &o, &c); err != nil {
+		t.Fatal(err)
+	}
+	if o.Client.String() != "example.com:8488" || o.Server != "" || o.Socks != "127.0.0.1:1080" {
+		t.Errorf("got client %q, server %q, socks %q", o.Client, o.Server, o.Socks)
+	}
+	if o.Cipher != "AEAD_AES_128_GCM" || o.Password != "file-password" {
+		t.Errorf("got cipher %q, password %q", o.Cipher, o.Password)
+	}
+	if c.UDPTimeout != time.Minute || !c.Verbose {
+		t.Errorf("got udptimeout %v, verbose %v", c.UDPTimeout, c.Verbose)
+	}
+
+	// flags given on the command line keep their values
+	setFlags(t, "s", "password", "udptimeout", "socks")
+	o = options{Server: ":8388", Password: "flag-password"}
+	c = globalConfig{UDPTimeout: time.Second}
+	if err := loadConfig(path, &o, &c); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.Client) != 0 || o.Server != ":8388" {
+		t.Errorf("-s: got client %q, server %q", o.Client, o.Server)
+	}
+	if o.Password != "flag-password" || o.Cipher != "AEAD_AES_128_GCM" {
+		t.Errorf("-password: got cipher %q, password %q", o.Cipher, o.Password)
+	}
+	if c.UDPTimeout != time.Second || o.Socks != "" {
+		t.Errorf("got udptimeout %v, socks %q", c.UDPTimeout, o.Socks)
+	}
+}
+
+func TestLoadConfigMode(t *testing.T) {
+	setFlags(t)
+	for _, tt := range []struct {
+		mode           string
+		tcp, udp       bool
+		tcpTun, udpTun string
+	}{
+		{"", true, false, ":53=8.8.8.8:53", ""},
+		{"tcp_only", true, false, ":53=8.8.8.8:53", ""},
+		{"udp_only", false, true, "", ":53=8.8.8.8:53"},
+		{"tcp_and_udp", true, true, ":53=8.8.8.8:53", ":53=8.8.8.8:53"},
+	} {
+		path := writeConfig(t, `{"server": "example.com", "server_port": 8488, "local_port": 1080,
+			"mode": "`+tt.mode+`", "tunnels": [":53=8.8.8.8:53"]}`)
+		o := options{TCP: true}
+		if err := loadConfig(path, &o, &globalConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		if o.TCPTun != tt.tcpTun || o.UDPTun != tt.udpTun || o.UDPSocks != tt.udp {
+			t.Errorf("client mode %q: got tcptun %q, udptun %q, -u %v", tt.mode, o.TCPTun, o.UDPTun, o.UDPSocks)
+		}
+
+		path = writeConfig(t, `{"server": "0.0.0.0", "server_port": 8488, "mode": "`+tt.mode+`"}`)
+		o = options{TCP: true}
+		if err := loadConfig(path, &o, &globalConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		if o.Server != "0.0.0.0:8488" || o.TCP != tt.tcp || o.UDP != tt.udp {
+			t.Errorf("server mode %q: got server %q, tcp %v, udp %v", tt.mode, o.Server, o.TCP, o.UDP)
+		}
+	}
+	if err := loadConfig(writeConfig(t, `{"mode": "tcp"}`), &options{}, &globalConfig{}); err == nil {
+		t.Error("accepted mode tcp")
+	}
+}
+
+func TestLoadConfigKey(t *testing.T) {
+	setFlags(t)
+	key := make([]byte, 32)
+	key[0], key[1] = 0xfb, 0xff // + and / in standard base64
+	std := base64.StdEncoding.EncodeToString(key)
+
+	// key in standard base64 as in shadowsocks-libev, passed on as -key
+	var o options
+	path := writeConfig(t, `{"server": "0.0.0.0", "server_port": 8488, "method": "2022-blake3-aes-256-gcm", "key": "`+std+`"}`)
+	if err := loadConfig(path, &o, &globalConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if o.Key != base64.URLEncoding.EncodeToString(key) {
+		t.Fatalf("got key %q", o.Key)
+	}
+	k, err := base64.URLEncoding.DecodeString(o.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := core.PickCipher(o.Cipher, k, ""); err != nil {
+		t.Error(err)
+	}
+
+	// base64 key as password
+	o = options{}
+	path = writeConfig(t, `{"server": "0.0.0.0", "server_port": 8488, "method": "2022-blake3-aes-256-gcm", "password": "`+std+`"}`)
+	if err := loadConfig(path, &o, &globalConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if o.Key != "" || o.Password != std {
+		t.Fatalf("got key %q, password %q", o.Key, o.Password)
+	}
+	if _, err := core.PickCipher(o.Cipher, nil, o.Password); err != nil {
+		t.Error(err)
+	}
+
+	path = writeConfig(t, `{"server": "0.0.0.0", "server_port": 8488, "key": "not base64!"}`)
+	if err := loadConfig(path, &options{}, &globalConfig{}); err == nil {
+		t.Error("accepted invalid key")
+	}
+}
+
+func TestLoadConfigServers(t *testing.T) {
+	setFlags(t)
+	path := writeConfig(t, `{
+		"method": "AEAD_AES_128_GCM", "password": "p@ss/word", "plugin": "v2ray-plugin", "plugin_opts": "tls;host=example.com",
+		"servers": [
+			{"server": "a.example.com", "server_port": 8488},
+			{"server": "::1", "server_port": 8489, "method": "2022-blake3-aes-128-gcm", "password": "AAAAAAAAAAAAAAAAAAAAAA==", "plugin": "obfs-local"}
+		]
+	}`)
+	var o options
+	if err := loadConfig(path, &o, &globalConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.Client) != 2 {
+		t.Fatalf("got servers %q", o.Client)
+	}
+	for i, want := range []ssURL{
+		{"a.example.com:8488", "AEAD_AES_128_GCM", "p@ss/word", "v2ray-plugin", "tls;host=example.com"},
+		{"[::1]:8489", "2022-blake3-aes-128-gcm", "AAAAAAAAAAAAAAAAAAAAAA==", "obfs-local", ""},
+	} {
+		u, err := parseURL(o.Client[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *u != want {
+			t.Errorf("server %q: got %+v, want %+v", o.Client[i], *u, want)
+		}
+	}
+
+	// -c replaces the servers
+	setFlags(t, "c")
+	o = options{Client: stringsFlag{"example.org:8488"}}
+	if err := loadConfig(path, &o, &globalConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if o.Client.String() != "example.org:8488" {
+		t.Errorf("-c: got servers %q", o.Client)
+	}
+
+	path = writeConfig(t, `{"servers": [{"server": "a.example.com"}]}`)
+	if err := loadConfig(path, &options{}, &globalConfig{}); err == nil {
+		t.Error("accepted server without port")
+	}
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	setFlags(t)
+	err := loadConfig(writeConfig(t, `{"server": "0.0.0.0", "server_port": 8488, "fast_open": true}`), &options{}, &globalConfig{})
+	if err == nil || !strings.Contains(err.Error(), "fast_open") {
+		t.Errorf("got %v, want unknown field error", err)
+	}
+}
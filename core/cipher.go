@@ -1,13 +1,16 @@
 package core
 
 import (
+	"crypto/cipher"
 	"crypto/md5"
+	"encoding/base64"
 	"errors"
 	"net"
 	"sort"
 	"strings"
 
 	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead2022"
 )
 
 type Cipher interface {
@@ -42,18 +45,53 @@ var aeadList = map[string]struct {
 	aeadChacha20Poly1305: {32, shadowaead.Chacha20Poly1305},
 }
 
+const (
+	aead2022Blake3Aes128Gcm        = "2022-blake3-aes-128-gcm"
+	aead2022Blake3Aes256Gcm        = "2022-blake3-aes-256-gcm"
+	aead2022Blake3Chacha20Poly1305 = "2022-blake3-chacha20-poly1305"
+)
+
+// List of Shadowsocks 2022 ciphers: key size in bytes and constructor
+var aead2022List = map[string]struct {
+	KeySize int
+	New     func([]byte) (shadowaead2022.Cipher, error)
+}{
+	aead2022Blake3Aes128Gcm:        {16, shadowaead2022.AESGCM},
+	aead2022Blake3Aes256Gcm:        {32, shadowaead2022.AESGCM},
+	aead2022Blake3Chacha20Poly1305: {32, shadowaead2022.Chacha20Poly1305},
+}
+
 // ListCipher returns a list of available cipher names sorted alphabetically.
 func ListCipher() []string {
 	var l []string
 	for k := range aeadList {
 		l = append(l, k)
 	}
+	for k := range aead2022List {
+		l = append(l, k)
+	}
 	sort.Strings(l)
 	return l
 }
 
 // PickCipher returns a Cipher of the given name. Derive key from password if given key is empty.
+// Shadowsocks 2022 ciphers take the password as base64-encoded key instead.
 func PickCipher(name string, key []byte, password string) (Cipher, error) {
+	if choice, ok := aead2022List[strings.ToLower(name)]; ok {
+		if len(key) == 0 {
+			k, err := base64.StdEncoding.DecodeString(password)
+			if err != nil {
+				return nil, err
+			}
+			key = k
+		}
+		if len(key) != choice.KeySize {
+			return nil, shadowaead2022.KeySizeError(choice.KeySize)
+		}
+		aead, err := choice.New(key)
+		return &aead2022Cipher{aead}, err
+	}
+
 	name = strings.ToUpper(name)
 
 	switch name {
@@ -81,6 +119,21 @@ func PickCipher(name string, key []byte, password string) (Cipher, error) {
 	return nil, ErrCipherNotSupported
 }
 
+// tagSize is the overhead of all supported AEADs.
+const tagSize = 16
+
+var zeroNonce [24]byte
+
+// openHeader reports whether the chunk following salt in b decrypts with the subkey derived from salt.
+func openHeader(b []byte, saltSize int, decrypter func(salt []byte) (cipher.AEAD, error)) bool {
+	aead, err := decrypter(b[:saltSize])
+	if err != nil {
+		return false
+	}
+	_, err = aead.Open(nil, zeroNonce[:aead.NonceSize()], b[saltSize:], nil)
+	return err == nil
+}
+
 type aeadCipher struct{ shadowaead.Cipher }
 
 func (aead *aeadCipher) StreamConn(c net.Conn) net.Conn { return shadowaead.NewConn(c, aead) }
@@ -88,6 +141,27 @@ func (aead *aeadCipher) PacketConn(c net.PacketConn) net.PacketConn {
 	return shadowaead.NewPacketConn(c, aead)
 }
 
+// salt and encrypted length of the first payload
+func (aead *aeadCipher) headerSize() int { return aead.SaltSize() + 2 + tagSize }
+func (aead *aeadCipher) matchHeader(b []byte) bool {
+	return openHeader(b, aead.SaltSize(), aead.Decrypter)
+}
+
+type aead2022Cipher struct{ shadowaead2022.Cipher }
+
+func (aead *aead2022Cipher) StreamConn(c net.Conn) net.Conn {
+	return shadowaead2022.NewConn(c, aead)
+}
+func (aead *aead2022Cipher) PacketConn(c net.PacketConn) net.PacketConn {
+	return shadowaead2022.NewPacketConn(c, aead)
+}
+
+// salt and encrypted fixed-length request header
+func (aead *aead2022Cipher) headerSize() int { return aead.SaltSize() + 1 + 8 + 2 + tagSize }
+func (aead *aead2022Cipher) matchHeader(b []byte) bool {
+	return openHeader(b, aead.SaltSize(), aead.Decrypter)
+}
+
 // dummy cipher does not encrypt
 type dummy struct{}
 
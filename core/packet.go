@@ -1,8 +1,23 @@
 package core
 
-import "net"
+import (
+	"context"
+	"net"
+)
 
 func ListenPacket(network, address string, ciph PacketConnCipher) (net.PacketConn, error) {
 	c, err := net.ListenPacket(network, address)
-	return ciph.PacketConn(c), err
+	if err != nil {
+		return nil, err
+	}
+	return ciph.PacketConn(c), nil
+}
+
+// ListenPacketContext is like ListenPacket but with the options of lc.
+func ListenPacketContext(ctx context.Context, lc *net.ListenConfig, network, address string, ciph PacketConnCipher) (net.PacketConn, error) {
+	c, err := lc.ListenPacket(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return ciph.PacketConn(c), nil
 }
@@ -1,6 +1,13 @@
 package core
 
-import "net"
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
 
 type listener struct {
 	net.Listener
@@ -9,15 +16,98 @@ type listener struct {
 
 func Listen(network, address string, ciph StreamConnCipher) (net.Listener, error) {
 	l, err := net.Listen(network, address)
-	return &listener{l, ciph}, err
+	if err != nil {
+		return nil, err
+	}
+	return &listener{l, ciph}, nil
+}
+
+// ListenContext is like Listen but with the options of lc.
+func ListenContext(ctx context.Context, lc *net.ListenConfig, network, address string, ciph StreamConnCipher) (net.Listener, error) {
+	l, err := lc.Listen(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{l, ciph}, nil
 }
 
 func (l *listener) Accept() (net.Conn, error) {
 	c, err := l.Listener.Accept()
-	return l.StreamConn(c), err
+	if err != nil {
+		return nil, err
+	}
+	return l.StreamConn(c), nil
 }
 
 func Dial(network, address string, ciph StreamConnCipher) (net.Conn, error) {
 	c, err := net.Dial(network, address)
-	return ciph.StreamConn(c), err
+	if err != nil {
+		return nil, err
+	}
+	return ciph.StreamConn(c), nil
+}
+
+// DialContext is like Dial but cancels connecting when ctx is done.
+func DialContext(ctx context.Context, network, address string, ciph StreamConnCipher) (net.Conn, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return ciph.StreamConn(c), nil
+}
+
+// Connect requests tgt on sc, an encrypted connection to a Shadowsocks server, and returns sc.
+// Sending the request is bounded by the deadline of ctx.
+func Connect(ctx context.Context, sc net.Conn, tgt socks.Addr) (net.Conn, error) {
+	if d, ok := ctx.Deadline(); ok {
+		sc.SetWriteDeadline(d)
+		defer sc.SetWriteDeadline(time.Time{})
+	}
+	if _, err := sc.Write(tgt); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Dialer connects to targets through a Shadowsocks server.
+type Dialer struct {
+	net.Dialer // connects to the server
+
+	Server string // address of the server
+	Cipher StreamConnCipher
+}
+
+// Dial connects to addr through the server. Only TCP networks are supported.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the server. Connecting to the server and sending the
+// request are cancelled when ctx is done.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	tgt := socks.ParseAddr(addr)
+	if tgt == nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("invalid target address " + addr)}
+	}
+	return d.DialAddr(ctx, tgt)
+}
+
+// DialAddr connects to tgt through the server.
+func (d *Dialer) DialAddr(ctx context.Context, tgt socks.Addr) (net.Conn, error) {
+	c, err := d.Dialer.DialContext(ctx, "tcp", d.Server)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := Connect(ctx, d.Cipher.StreamConn(c), tgt)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return sc, nil
 }
@@ -0,0 +1,56 @@
+package core_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func TestDialer(t *testing.T) {
+	ciph, err := core.PickCipher("AEAD_AES_128_GCM", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lc net.ListenConfig
+	l, err := core.ListenContext(context.Background(), &lc, "tcp", "127.0.0.1:0", ciph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	tgts := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		tgt, err := socks.ReadAddr(c)
+		if err != nil {
+			tgts <- err.Error()
+			return
+		}
+		tgts <- tgt.String()
+	}()
+
+	d := &core.Dialer{Server: l.Addr().String(), Cipher: ciph}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.DialContext(ctx, "tcp", "example.com:80"); err == nil {
+		t.Fatal("DialContext with cancelled context succeeded")
+	}
+	if _, err := d.DialContext(context.Background(), "udp", "example.com:53"); err == nil {
+		t.Fatal("DialContext with UDP succeeded")
+	}
+
+	c, err := d.DialContext(context.Background(), "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := <-tgts; got != "example.com:80" {
+		t.Fatalf("server got target %q, want example.com:80", got)
+	}
+}
@@ -0,0 +1,310 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrUnknownUser means no user's key can decrypt the incoming data.
+var ErrUnknownUser = errors.New("no matching user")
+
+// errUnidentified means writing to a connection before its user is identified.
+var errUnidentified = errors.New("user not identified yet")
+
+// User is a named cipher sharing a server port with other users.
+type User struct {
+	Name string
+	Cipher
+}
+
+// UserConn is a connection of an identified user.
+type UserConn interface {
+	net.Conn
+	User() string
+}
+
+// UserAddr is the source address of a packet from an identified user.
+type UserAddr interface {
+	net.Addr
+	User() string
+}
+
+// headerMatcher is implemented by ciphers able to tell whether a stream is encrypted with their key.
+type headerMatcher interface {
+	// headerSize returns the number of leading bytes of a stream needed by matchHeader.
+	headerSize() int
+	// matchHeader reports whether b, the leading bytes of a stream, decrypts with this cipher.
+	matchHeader(b []byte) bool
+}
+
+type userEntry struct {
+	*User
+	headerMatcher
+}
+
+// userCipher identifies the user of each connection or packet by trying all keys,
+// most recently matched first.
+type userCipher struct {
+	sync.Mutex
+	users []*userEntry // most recently matched first
+	sizes []int        // distinct header sizes in ascending order
+}
+
+// UserCipher returns a Cipher for a server shared by users. Incoming connections
+// and packets are decrypted by whichever user's key fits, which is then reported by
+// UserConn and UserAddr.
+func UserCipher(users []User) (Cipher, error) {
+	if len(users) == 0 {
+		return nil, errors.New("no users")
+	}
+	uc := &userCipher{}
+	seen := make(map[int]bool)
+	for i := range users {
+		m, ok := users[i].Cipher.(headerMatcher)
+		if !ok {
+			return nil, ErrCipherNotSupported
+		}
+		uc.users = append(uc.users, &userEntry{&users[i], m})
+		if size := m.headerSize(); !seen[size] {
+			seen[size] = true
+			uc.sizes = append(uc.sizes, size)
+		}
+	}
+	sort.Ints(uc.sizes)
+	return uc, nil
+}
+
+func (uc *userCipher) list() []*userEntry {
+	uc.Lock()
+	defer uc.Unlock()
+	return append([]*userEntry(nil), uc.users...)
+}
+
+// promote moves u to the front of the list.
+func (uc *userCipher) promote(u *userEntry) {
+	uc.Lock()
+	defer uc.Unlock()
+	for i, v := range uc.users {
+		if v == u {
+			copy(uc.users[1:i+1], uc.users[:i])
+			uc.users[0] = u
+			return
+		}
+	}
+}
+
+// match reads the leading bytes of r until they decrypt with one of the users' keys.
+// Returns the user and the bytes read.
+func (uc *userCipher) match(r io.Reader) (*userEntry, []byte, error) {
+	users := uc.list()
+	buf := make([]byte, uc.sizes[len(uc.sizes)-1])
+	n := 0
+	for _, size := range uc.sizes { // read no more than needed for users with shorter headers
+		if _, err := io.ReadFull(r, buf[n:size]); err != nil {
+			return nil, buf[:n], err
+		}
+		n = size
+		for _, u := range users {
+			if u.headerSize() == size && u.matchHeader(buf[:size]) {
+				uc.promote(u)
+				return u, buf[:n], nil
+			}
+		}
+	}
+	return nil, buf[:n], ErrUnknownUser
+}
+
+func (uc *userCipher) StreamConn(c net.Conn) net.Conn { return &userConn{Conn: c, uc: uc} }
+
+func (uc *userCipher) PacketConn(c net.PacketConn) net.PacketConn {
+	pc := &userPacketConn{PacketConn: c, uc: uc}
+	pc.peers = make(map[string]*userEntry)
+	pc.lastSeen = make(map[string]time.Time)
+	pc.conns = make(map[*userEntry]*userPacket)
+	for _, u := range uc.users {
+		p := &userPacket{PacketConn: c}
+		p.pc = u.PacketConn(p)
+		pc.conns[u] = p
+	}
+	return pc
+}
+
+// prefixConn reads prefix before reading from the embedded net.Conn.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+type userConn struct {
+	net.Conn
+	uc   *userCipher
+	user *userEntry
+	sc   net.Conn // stream of the matched user
+}
+
+func (c *userConn) init() error {
+	if c.sc != nil {
+		return nil
+	}
+	u, prefix, err := c.uc.match(c.Conn)
+	if err != nil {
+		return err
+	}
+	c.user = u
+	c.sc = u.StreamConn(&prefixConn{Conn: c.Conn, prefix: prefix})
+	return nil
+}
+
+// User returns the name of the matched user, or "" if not identified yet.
+func (c *userConn) User() string {
+	if c.user == nil {
+		return ""
+	}
+	return c.user.Name
+}
+
+func (c *userConn) Read(b []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	return c.sc.Read(b)
+}
+
+func (c *userConn) WriteTo(w io.Writer) (int64, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, c.sc)
+}
+
+func (c *userConn) Write(b []byte) (int, error) {
+	if c.sc == nil {
+		return 0, errUnidentified
+	}
+	return c.sc.Write(b)
+}
+
+func (c *userConn) ReadFrom(r io.Reader) (int64, error) {
+	if c.sc == nil {
+		return 0, errUnidentified
+	}
+	return io.Copy(c.sc, r)
+}
+
+// userAddr tags a packet source address with its user.
+type userAddr struct {
+	net.Addr
+	user *userEntry
+}
+
+func (a *userAddr) User() string { return a.user.Name }
+
+// userPacket feeds a received packet to the PacketConn of a user and writes through to the shared socket.
+type userPacket struct {
+	net.PacketConn
+	pc   net.PacketConn // wraps userPacket with the user's cipher
+	pkt  []byte
+	addr net.Addr
+}
+
+func (p *userPacket) ReadFrom(b []byte) (int, net.Addr, error) {
+	if len(b) < len(p.pkt) {
+		return 0, p.addr, io.ErrShortBuffer
+	}
+	return copy(b, p.pkt), p.addr, nil
+}
+
+// peerTimeout is how long the user of a source address is remembered.
+const peerTimeout = 5 * time.Minute
+
+type userPacketConn struct {
+	net.PacketConn
+	uc    *userCipher
+	conns map[*userEntry]*userPacket // read-only
+	sync.Mutex
+	peers     map[string]*userEntry // last user seen by source address
+	lastSeen  map[string]time.Time
+	lastPrune time.Time
+}
+
+func (c *userPacketConn) seen(addr net.Addr, u *userEntry) {
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	c.peers[addr.String()] = u
+	c.lastSeen[addr.String()] = now
+	if now.Sub(c.lastPrune) < time.Minute {
+		return
+	}
+	for k, t := range c.lastSeen {
+		if now.Sub(t) > peerTimeout {
+			delete(c.peers, k)
+			delete(c.lastSeen, k)
+		}
+	}
+	c.lastPrune = now
+}
+
+// ReadFrom reads a packet and tries to decrypt it with the key of the last user seen at the
+// same source address first, then all other users.
+func (c *userPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	pkt := append([]byte(nil), b[:n]...)
+
+	c.Lock()
+	last := c.peers[addr.String()]
+	c.Unlock()
+	users := c.uc.list()
+	if last != nil {
+		users = append([]*userEntry{last}, users...)
+	}
+	for i, u := range users {
+		if u == last && i > 0 {
+			continue
+		}
+		p := c.conns[u]
+		p.pkt, p.addr = pkt, addr
+		n, _, err := p.pc.ReadFrom(b)
+		p.pkt, p.addr = nil, nil
+		if err == nil {
+			if u != last {
+				c.uc.promote(u)
+			}
+			c.seen(addr, u)
+			return n, &userAddr{Addr: addr, user: u}, nil
+		}
+	}
+	return 0, addr, ErrUnknownUser
+}
+
+// WriteTo encrypts b with the key of the user at addr.
+func (c *userPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	var u *userEntry
+	if ua, ok := addr.(*userAddr); ok {
+		u, addr = ua.user, ua.Addr
+	} else {
+		c.Lock()
+		u = c.peers[addr.String()]
+		c.Unlock()
+	}
+	if u == nil {
+		return 0, ErrUnknownUser
+	}
+	return c.conns[u].pc.WriteTo(b, addr)
+}
@@ -0,0 +1,120 @@
+package core_test
+
+import (
+	"encoding/base64"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func TestMain(m *testing.M) {
+	// clients and servers share the salt filter in one process
+	os.Setenv("SHADOWSOCKS_SF_CAPACITY", "0")
+	os.Exit(m.Run())
+}
+
+func TestUserCipherStream(t *testing.T) {
+	var users []core.User
+	for _, u := range []struct{ name, cipher, password string }{
+		{"alice", "AEAD_AES_128_GCM", "alice-password"},
+		{"bob", "2022-blake3-aes-256-gcm", base64.StdEncoding.EncodeToString(make([]byte, 32))},
+		{"carol", "AEAD_CHACHA20_POLY1305", "carol-password"},
+	} {
+		ciph, err := core.PickCipher(u.cipher, nil, u.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, core.User{Name: u.name, Cipher: ciph})
+	}
+	server, err := core.UserCipher(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tgt := socks.ParseAddr("1.2.3.4:80") // shortest first flight
+	for _, u := range append(users, users...) {
+		left, right := net.Pipe()
+		go u.StreamConn(left).Write(tgt)
+		sc := server.StreamConn(right)
+		addr, err := socks.ReadAddr(sc)
+		if err != nil {
+			t.Fatalf("%s: %v", u.Name, err)
+		}
+		if addr.String() != tgt.String() {
+			t.Fatalf("%s: got target %v, want %v", u.Name, addr, tgt)
+		}
+		if got := sc.(core.UserConn).User(); got != u.Name {
+			t.Fatalf("got user %q, want %q", got, u.Name)
+		}
+		left.Close()
+		right.Close()
+	}
+}
+
+func TestUserCipherPacket(t *testing.T) {
+	var users []core.User
+	for _, u := range []struct{ name, cipher, password string }{
+		{"alice", "AEAD_AES_128_GCM", "alice-password"},
+		{"bob", "AEAD_CHACHA20_POLY1305", "bob-password"},
+	} {
+		ciph, err := core.PickCipher(u.cipher, nil, u.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, core.User{Name: u.name, Cipher: ciph})
+	}
+	server, err := core.UserCipher(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spc.Close()
+	spc = server.PacketConn(spc)
+
+	tgt := socks.ParseAddr("1.2.3.4:53")
+	buf := make([]byte, 1024)
+	for _, u := range append(users, users...) {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc := u.PacketConn(c)
+		pc.SetDeadline(time.Now().Add(5 * time.Second))
+		spc.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := pc.WriteTo(append(append([]byte(nil), tgt...), "hello "+u.Name...), spc.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		n, addr, err := spc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", u.Name, err)
+		}
+		if got := string(buf[len(tgt):n]); got != "hello "+u.Name {
+			t.Fatalf("%s: got %q", u.Name, got)
+		}
+		if got := addr.(core.UserAddr).User(); got != u.Name {
+			t.Fatalf("got user %q, want %q", got, u.Name)
+		}
+
+		// replies go back under the cipher of the user, also when sent to the bare address
+		for _, to := range []net.Addr{addr, c.LocalAddr()} {
+			if _, err := spc.WriteTo(append(append([]byte(nil), tgt...), "reply to "+u.Name...), to); err != nil {
+				t.Fatalf("%s: %v", u.Name, err)
+			}
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("%s: reply to %v: %v", u.Name, to, err)
+			}
+			if got := string(buf[len(tgt):n]); got != "reply to "+u.Name {
+				t.Fatalf("%s: got reply %q", u.Name, got)
+			}
+		}
+		pc.Close()
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/shadowsocks/go-shadowsocks2/dns"
+	"github.com/shadowsocks/go-shadowsocks2/route"
+	"github.com/shadowsocks/go-shadowsocks2/service"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// dnsForwarder answers queries on the -dns listener with the current configuration.
+var dnsForwarder *dns.Forwarder
+
+// fakeIP gives the addresses of -fake-ip to names resolved through the server.
+var fakeIP *dns.FakeIP
+
+// dnsRoute returns the function choosing the upstream of each name as configured by o: the
+// direct resolver for names in -dns-direct-domains, otherwise the resolver reached through
+// the client servers, or fake addresses with -fake-ip. Geosite lists are looked up in dbs.
+func dnsRoute(o *options, dbs *route.Databases) (func(name string) dns.Exchanger, error) {
+	if err := checkResolver(o.DNSUpstream); err != nil {
+		return nil, err
+	}
+	tunnel := &dns.Upstream{
+		Addr: o.DNSUpstream,
+		Dial: func(ctx context.Context, addr string) (net.Conn, error) {
+			return client.Dial(ctx, socks.ParseAddr(addr))
+		},
+	}
+	if !o.DNSTCP {
+		tunnel.ListenPacket = func() (net.PacketConn, error) { return client.ListenPacket() }
+	}
+	var proxied dns.Exchanger = tunnel
+	if fakeIP != nil {
+		proxied = fakeIP.Exchanger(tunnel)
+	}
+
+	var suffixes, lists []string
+	for _, d := range strings.Split(o.DNSDirectDomains, ",") {
+		d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+		switch {
+		case d == "":
+		case strings.HasPrefix(d, "geosite:"):
+			name := strings.TrimPrefix(d, "geosite:")
+			if dbs.Geosite == nil {
+				return nil, fmt.Errorf("DNS direct domains geosite:%s without geosite lists", name)
+			}
+			if !dbs.Geosite.Has(name) {
+				return nil, fmt.Errorf("unknown geosite list %s", name)
+			}
+			lists = append(lists, name)
+		default:
+			suffixes = append(suffixes, d)
+		}
+	}
+	if o.DNSDirect == "" {
+		if len(suffixes)+len(lists) > 0 {
+			return nil, fmt.Errorf("DNS direct domains without direct resolver")
+		}
+		return func(string) dns.Exchanger { return proxied }, nil
+	}
+	if err := checkResolver(o.DNSDirect); err != nil {
+		return nil, err
+	}
+	direct := directUpstream(o.DNSDirect, false)
+	return func(name string) dns.Exchanger {
+		for _, d := range suffixes {
+			if name == d || strings.HasSuffix(name, "."+d) {
+				return direct
+			}
+		}
+		for _, l := range lists {
+			if dbs.Geosite.Match(l, name) {
+				return direct
+			}
+		}
+		return proxied
+	}, nil
+}
+
+// directUpstream returns the DNS server at addr queried directly, only over TCP if tcp.
+func directUpstream(addr string, tcp bool) *dns.Upstream {
+	u := &dns.Upstream{
+		Addr: addr,
+		Dial: func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", addr)
+		},
+	}
+	if !tcp {
+		u.ListenPacket = func() (net.PacketConn, error) { return net.ListenPacket("udp", "") }
+	}
+	return u
+}
+
+// serverResolver returns the resolver of server targets configured by o, or nil to resolve
+// them with the system resolver.
+func serverResolver(o *options) (service.Resolver, error) {
+	if o.Resolver == "" && o.ResolverHosts == "" && o.ResolverPrefer == "" {
+		return nil, nil
+	}
+	var ups []dns.Exchanger
+	for _, s := range strings.Split(o.Resolver, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		addr := strings.TrimPrefix(s, "tcp://")
+		if err := checkResolver(addr); err != nil {
+			return nil, err
+		}
+		ups = append(ups, directUpstream(addr, addr != s))
+	}
+	var hosts map[string][]net.IP
+	if o.ResolverHosts != "" {
+		h, err := dns.ReadHosts(o.ResolverHosts)
+		if err != nil {
+			return nil, err
+		}
+		hosts = h
+	}
+	prefer := dns.PreferIPv4
+	if o.ResolverPrefer != "" {
+		p, err := dns.ParsePreference(o.ResolverPrefer)
+		if err != nil {
+			return nil, err
+		}
+		prefer = p
+	}
+	return dns.NewResolver(ups, hosts, prefer), nil
+}
+
+// checkResolver checks that addr is the IP address and port of a DNS server.
+func checkResolver(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) == nil || socks.ParseAddr(addr) == nil {
+		return fmt.Errorf("invalid DNS server %q: want ip:port", addr)
+	}
+	return nil
+}
+
+// realTarget returns tgt with an address of -fake-ip replaced by the name it was given to.
+func realTarget(tgt socks.Addr) socks.Addr {
+	if fakeIP == nil || len(tgt) == 0 || tgt[0] != socks.AtypIPv4 {
+		return tgt
+	}
+	name, ok := fakeIP.Name(net.IP(tgt[1 : 1+net.IPv4len]))
+	if !ok {
+		return tgt
+	}
+	port := int(tgt[1+net.IPv4len])<<8 | int(tgt[1+net.IPv4len+1])
+	if a := socks.ParseAddr(net.JoinHostPort(name, strconv.Itoa(port))); a != nil {
+		return a
+	}
+	return tgt
+}
+
+// Listen on addr for DNS queries over UDP and TCP, and answer them with the forwarder.
+func dnsLocal(addr string) (io.Closer, error) {
+	logf("DNS forwarder %s", addr)
+	pc, err := listenPacket(addr, dnsForwarder.ServePacket)
+	if err != nil {
+		return nil, err
+	}
+	l, err := listen(addr, func(l net.Listener) error { return client.ServeConn(l, dnsForwarder.ServeConn) })
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return closers{pc, l}, nil
+}
+
+// closers closes all its elements.
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var err error
+	for _, c := range cs {
+		if e := c.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
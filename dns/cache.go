@@ -0,0 +1,123 @@
+package dns
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// cacheKey is the question of a query, with the name in lower case.
+type cacheKey struct {
+	name  string
+	typ   uint16
+	class uint16
+}
+
+type cacheEntry struct {
+	msg     *dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// cache keeps responses for the lowest TTL of their records, or the negative caching time of
+// the SOA record for those without answers, as in RFC 2308. Responses with records of types
+// dnsmessage can't parse are not cached.
+type cache struct {
+	mu  sync.Mutex
+	m   map[cacheKey]*cacheEntry
+	max int
+}
+
+func newCache(max int) *cache {
+	return &cache{m: make(map[cacheKey]*cacheEntry), max: max}
+}
+
+// get returns a copy of the response to key with id and TTLs reduced by the time in cache,
+// or nil.
+func (c *cache) get(key cacheKey, id uint16) []byte {
+	now := time.Now()
+	c.mu.Lock()
+	e := c.m[key]
+	if e != nil && !now.Before(e.expires) {
+		delete(c.m, key)
+		e = nil
+	}
+	c.mu.Unlock()
+	if e == nil {
+		return nil
+	}
+
+	m := *e.msg
+	m.ID = id
+	age := uint32(now.Sub(e.stored) / time.Second)
+	for _, rrs := range []*[]dnsmessage.Resource{&m.Answers, &m.Authorities, &m.Additionals} {
+		*rrs = append([]dnsmessage.Resource(nil), *rrs...)
+		for i := range *rrs {
+			if r := &(*rrs)[i]; r.Header.Type != dnsmessage.TypeOPT {
+				r.Header.TTL -= age
+			}
+		}
+	}
+	msg, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// put stores msg as the response to key if it can be cached.
+func (c *cache) put(key cacheKey, msg []byte) {
+	m := new(dnsmessage.Message)
+	if err := m.Unpack(msg); err != nil {
+		return
+	}
+	ttl, ok := cacheTTL(m)
+	if !ok || ttl == 0 {
+		return
+	}
+	now := time.Now()
+	e := &cacheEntry{msg: m, stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.m) >= c.max {
+		for k, e := range c.m {
+			if !now.Before(e.expires) {
+				delete(c.m, k)
+			}
+		}
+		// evict an arbitrary entry if all are fresh
+		for k := range c.m {
+			if len(c.m) < c.max {
+				break
+			}
+			delete(c.m, k)
+		}
+	}
+	c.m[key] = e
+}
+
+// cacheTTL returns how long m can be cached in seconds, and false if it can't be.
+func cacheTTL(m *dnsmessage.Message) (uint32, bool) {
+	if m.Truncated || m.RCode != dnsmessage.RCodeSuccess && m.RCode != dnsmessage.RCodeNameError {
+		return 0, false
+	}
+	var ttl uint32
+	found := false
+	for sec, rrs := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for _, r := range rrs {
+			if r.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			t := r.Header.TTL
+			if soa, ok := r.Body.(*dnsmessage.SOAResource); ok && sec == 1 && soa.MinTTL < t {
+				t = soa.MinTTL
+			}
+			if !found || t < ttl {
+				ttl, found = t, true
+			}
+		}
+	}
+	return ttl, found
+}
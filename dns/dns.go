@@ -0,0 +1,247 @@
+// Package dns implements a caching DNS forwarder choosing upstream servers by domain.
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Logger is implemented by *log.Logger.
+type Logger interface {
+	Output(calldepth int, s string) error
+}
+
+// Exchanger answers DNS queries in wire format.
+type Exchanger interface {
+	Exchange(ctx context.Context, q []byte) ([]byte, error)
+}
+
+// defaultTimeout bounds exchanges whose context has no deadline.
+const defaultTimeout = 5 * time.Second
+
+// idleTimeout is how long the socket of an Upstream stays open without queries.
+const idleTimeout = time.Minute
+
+// Upstream is a DNS server queried over UDP, retrying over TCP when responses are truncated,
+// or only over TCP if ListenPacket is nil. Queries over UDP share one socket, under IDs of
+// their own while sent, which is closed after idleTimeout without queries.
+type Upstream struct {
+	Addr string // IP address and port of the server
+
+	// ListenPacket opens a socket sending packets to Addr.
+	ListenPacket func() (net.PacketConn, error)
+
+	// Dial connects to Addr over TCP.
+	Dial func(ctx context.Context, addr string) (net.Conn, error)
+
+	mu   sync.Mutex
+	sock *socket
+}
+
+// socket is the socket of an Upstream with the queries waiting for a response by ID.
+type socket struct {
+	pc      net.PacketConn
+	addr    net.Addr
+	done    chan struct{} // closed with err once pc can't be read
+	err     error
+	pending map[uint16]*pending // guarded by the mutex of the Upstream
+}
+
+type pending struct {
+	q    []byte // as sent, with the ID of the socket
+	resp chan []byte
+}
+
+// Exchange sends q to the server and returns its response.
+func (u *Upstream) Exchange(ctx context.Context, q []byte) ([]byte, error) {
+	if _, err := header(q); err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+	if u.ListenPacket != nil {
+		resp, err := u.exchangeUDP(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		if h, _ := header(resp); !h.Truncated {
+			return resp, nil
+		}
+	}
+	return u.exchangeTCP(ctx, q)
+}
+
+func (u *Upstream) exchangeUDP(ctx context.Context, q []byte) ([]byte, error) {
+	s, p, err := u.send(q)
+	if err != nil {
+		return nil, err
+	}
+	defer u.remove(s, p)
+	select {
+	case resp := <-p.resp:
+		copy(resp[:2], q[:2])
+		return resp, nil
+	case <-s.done:
+		return nil, s.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// send sends q on the socket, opened if needed, under an unused ID.
+func (u *Upstream) send(q []byte) (*socket, *pending, error) {
+	u.mu.Lock()
+	s := u.sock
+	if s == nil {
+		addr, err := net.ResolveUDPAddr("udp", u.Addr)
+		if err != nil {
+			u.mu.Unlock()
+			return nil, nil, err
+		}
+		pc, err := u.ListenPacket()
+		if err != nil {
+			u.mu.Unlock()
+			return nil, nil, err
+		}
+		s = &socket{pc: pc, addr: addr, done: make(chan struct{}), pending: make(map[uint16]*pending)}
+		u.sock = s
+		go u.read(s)
+	}
+	p := &pending{q: append([]byte(nil), q...), resp: make(chan []byte, 1)}
+	for {
+		id, err := newID()
+		if err != nil {
+			u.mu.Unlock()
+			return nil, nil, err
+		}
+		if _, ok := s.pending[id]; !ok {
+			binary.BigEndian.PutUint16(p.q, id)
+			s.pending[id] = p
+			break
+		}
+	}
+	u.mu.Unlock()
+
+	if _, err := s.pc.WriteTo(p.q, s.addr); err != nil {
+		u.remove(s, p)
+		return nil, nil, err
+	}
+	return s, p, nil
+}
+
+// remove stops waiting for the response to p.
+func (u *Upstream) remove(s *socket, p *pending) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	id := binary.BigEndian.Uint16(p.q)
+	if s.pending[id] == p {
+		delete(s.pending, id)
+	}
+}
+
+// read passes the responses read from s to the queries waiting for them, until s fails or
+// stays idle, then closes it.
+func (u *Upstream) read(s *socket) {
+	buf := make([]byte, 64*1024)
+	for {
+		s.pc.SetReadDeadline(time.Now().Add(idleTimeout))
+		n, _, err := s.pc.ReadFrom(buf)
+		u.mu.Lock()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && len(s.pending) > 0 {
+				u.mu.Unlock()
+				continue
+			}
+			if u.sock == s {
+				u.sock = nil
+			}
+			s.err = err
+			close(s.done)
+			u.mu.Unlock()
+			s.pc.Close()
+			return
+		}
+		// skip stray packets
+		if h, err := header(buf[:n]); err == nil {
+			if p, ok := s.pending[h.ID]; ok && isResponse(p.q, buf[:n]) {
+				delete(s.pending, h.ID)
+				p.resp <- append([]byte(nil), buf[:n]...)
+			}
+		}
+		u.mu.Unlock()
+	}
+}
+
+func (u *Upstream) exchangeTCP(ctx context.Context, q []byte) ([]byte, error) {
+	c, err := u.Dial(ctx, u.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	stop := closeOnDone(ctx, c)
+	defer stop()
+	d, _ := ctx.Deadline()
+	c.SetDeadline(d)
+
+	if err := writeMsg(c, q); err != nil {
+		return nil, err
+	}
+	resp, err := readMsg(c)
+	if err != nil {
+		return nil, err
+	}
+	if !isResponse(q, resp) {
+		return nil, errors.New("dns: response does not match query")
+	}
+	return resp, nil
+}
+
+// closeOnDone closes c when ctx is done until stop is called.
+func closeOnDone(ctx context.Context, c io.Closer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// readMsg reads a message prefixed by its length, as over TCP.
+func readMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if _, err := header(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeMsg writes b prefixed by its length, as over TCP.
+func writeMsg(w io.Writer, b []byte) error {
+	if len(b) > 0xffff {
+		return errors.New("dns: message too long")
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	_, err := w.Write(buf)
+	return err
+}
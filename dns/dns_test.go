@@ -0,0 +1,397 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func query(t *testing.T, id uint16, name string) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	q, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// fakeUpstream answers A queries with 10.0.0.1 and a TTL of 60, recording the names.
+type fakeUpstream struct {
+	names []string
+}
+
+func (u *fakeUpstream) Exchange(ctx context.Context, q []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(q)
+	if err != nil {
+		return nil, err
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	u.names = append(u.names, question.Name.String())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, RecursionAvailable: true})
+	b.StartQuestions()
+	b.Question(question)
+	b.StartAnswers()
+	b.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60},
+		dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}})
+	return b.Finish()
+}
+
+func TestForwarderCache(t *testing.T) {
+	direct, tunnel := &fakeUpstream{}, &fakeUpstream{}
+	var routed []string
+	f := NewForwarder(func(name string) Exchanger {
+		routed = append(routed, name)
+		if name == "direct.example" {
+			return direct
+		}
+		return tunnel
+	})
+	ctx := context.Background()
+
+	if _, err := f.Exchange(ctx, query(t, 1, "Direct.Example.")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Exchange(ctx, query(t, 2, "other.example.")); err != nil {
+		t.Fatal(err)
+	}
+	if len(direct.names) != 1 || len(tunnel.names) != 1 {
+		t.Fatalf("routed %v: direct %v, tunnel %v", routed, direct.names, tunnel.names)
+	}
+
+	// cached with the new ID and TTL reduced by the age
+	f.cache.m[cacheKey{"other.example.", uint16(dnsmessage.TypeA), uint16(dnsmessage.ClassINET)}].stored = time.Now().Add(-10 * time.Second)
+	resp, err := f.Exchange(ctx, query(t, 3, "OTHER.example."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnel.names) != 1 {
+		t.Fatalf("not cached: %v", tunnel.names)
+	}
+	if id := binary.BigEndian.Uint16(resp); id != 3 {
+		t.Errorf("ID %d, want 3", id)
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil || len(m.Answers) != 1 {
+		t.Fatalf("answers %v, %v", m.Answers, err)
+	}
+	if ttl := m.Answers[0].Header.TTL; ttl != 50 {
+		t.Errorf("TTL %d, want 50", ttl)
+	}
+}
+
+// failing fails all queries.
+type failing struct{}
+
+func (failing) Exchange(context.Context, []byte) ([]byte, error) { return nil, net.ErrClosed }
+
+func TestServFail(t *testing.T) {
+	f := NewForwarder(func(string) Exchanger { return failing{} })
+	q := query(t, 7, "example.com.")
+	resp := f.answer(context.Background(), q)
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ID != 7 || !h.Response || h.RCode != dnsmessage.RCodeServerFailure || !h.RecursionDesired {
+		t.Errorf("header %+v", h)
+	}
+	if !isResponse(q, resp) {
+		t.Error("question not kept")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	q := query(t, 1, "example.com.")
+	name := dnsmessage.MustNewName("example.com.")
+	rb := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, Response: true, RecursionAvailable: true})
+	rb.StartQuestions()
+	rb.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	rb.StartAnswers()
+	// 839 bytes in all
+	for i := 0; i < 30; i++ {
+		rb.AResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: 60},
+			dnsmessage.AResource{A: [4]byte{10, 0, 0, byte(i)}})
+	}
+	resp, _ := rb.Finish()
+	tr := truncate(q, resp)
+	var m dnsmessage.Message
+	if err := m.Unpack(tr); err != nil || len(tr) != len(q) || !m.Truncated || !m.RecursionAvailable ||
+		len(m.Answers) != 0 || !isResponse(q, tr) {
+		t.Errorf("truncated to %d bytes: %+v, %v", len(tr), m, err)
+	}
+
+	// EDNS(0) allows 1232 bytes
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	b.StartAdditionals()
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, false)
+	b.OPTResource(opt, dnsmessage.OPTResource{})
+	q, _ = b.Finish()
+	if tr := truncate(q, resp); len(tr) != len(resp) {
+		t.Errorf("truncated to %d bytes despite EDNS(0)", len(tr))
+	}
+}
+
+func TestFakeIP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fakeip")
+	f, err := NewFakeIP("10.0.0.0/29", path) // 6 addresses
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := f.Exchanger(failing{}).Exchange(context.Background(), query(t, 1, "A.example."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !net.IP(resp[len(resp)-4:]).Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("answered %v", resp[len(resp)-4:])
+	}
+	for i := 2; i <= 7; i++ {
+		f.IP(fmt.Sprintf("%d.example", i))
+	}
+	if ip := f.IP("7.example"); !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("7.example at %v, want the oldest address reused", ip)
+	}
+	f.Close()
+
+	f, err = NewFakeIP("10.0.0.0/29", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, tt := range []struct {
+		ip   string
+		name string
+	}{
+		{"10.0.0.1", "7.example"},
+		{"10.0.0.2", "2.example"},
+		{"10.0.0.6", "6.example"},
+		{"10.0.0.7", ""},
+		{"192.168.0.1", ""},
+	} {
+		if name, _ := f.Name(net.ParseIP(tt.ip)); name != tt.name {
+			t.Errorf("%s is %q, want %q", tt.ip, name, tt.name)
+		}
+	}
+	if ip := f.IP("8.example"); !ip.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("8.example at %v, want 10.0.0.2 after restart", ip)
+	}
+}
+
+// stubRecords are the records of the stub server, by name and type. Names missing are
+// answered with NXDOMAIN, types missing with no answer, both with an SOA record.
+var stubRecords = map[string]map[dnsmessage.Type]net.IP{
+	"v4.test.":   {dnsmessage.TypeA: net.IPv4(192, 0, 2, 1)},
+	"dual.test.": {dnsmessage.TypeA: net.IPv4(192, 0, 2, 2), dnsmessage.TypeAAAA: net.ParseIP("2001:db8::2")},
+}
+
+func stubAnswer(q []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(q)
+	if err != nil {
+		return nil
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	records, ok := stubRecords[question.Name.String()]
+	rh := dnsmessage.Header{ID: h.ID, Response: true, RecursionAvailable: true}
+	if !ok {
+		rh.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, rh)
+	b.StartQuestions()
+	b.Question(question)
+	b.StartAnswers()
+	hdr := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}
+	switch ip := records[question.Type]; {
+	case ip == nil:
+		b.StartAuthorities()
+		soa := dnsmessage.MustNewName("test.")
+		b.SOAResource(dnsmessage.ResourceHeader{Name: soa, Class: dnsmessage.ClassINET, TTL: 3600},
+			dnsmessage.SOAResource{NS: soa, MBox: soa, MinTTL: 30})
+	case question.Type == dnsmessage.TypeA:
+		var a dnsmessage.AResource
+		copy(a.A[:], ip.To4())
+		b.AResource(hdr, a)
+	default:
+		var a dnsmessage.AAAAResource
+		copy(a.AAAA[:], ip)
+		b.AAAAResource(hdr, a)
+	}
+	resp, _ := b.Finish()
+	return resp
+}
+
+// stub serves stubRecords over UDP and TCP on the returned address, counting queries.
+func stub(t *testing.T) (string, *int32, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			m, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&n, 1)
+			pc.WriteTo(stubAnswer(buf[:m]), addr)
+		}
+	}()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					q, err := readMsg(c)
+					if err != nil {
+						return
+					}
+					atomic.AddInt32(&n, 1)
+					writeMsg(c, stubAnswer(q))
+				}
+			}()
+		}
+	}()
+	return pc.LocalAddr().String(), &n, func() { pc.Close(); l.Close() }
+}
+
+func TestUpstreamSocket(t *testing.T) {
+	addr, _, stop := stub(t)
+	defer stop()
+	var opened int32
+	u := &Upstream{
+		Addr: addr,
+		ListenPacket: func() (net.PacketConn, error) {
+			atomic.AddInt32(&opened, 1)
+			return net.ListenPacket("udp", "127.0.0.1:0")
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// concurrent queries with the same ID get their own response
+	names := []string{"v4.test.", "dual.test."}
+	errc := make(chan error, 20)
+	for i := 0; i < cap(errc); i++ {
+		q := query(t, 42, names[i%2])
+		go func() {
+			resp, err := u.Exchange(ctx, q)
+			if err == nil && !isResponse(q, resp) {
+				err = fmt.Errorf("got response %x to %x", resp, q)
+			}
+			errc <- err
+		}()
+	}
+	for i := 0; i < cap(errc); i++ {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+	if opened := atomic.LoadInt32(&opened); opened != 1 {
+		t.Errorf("opened %d sockets, want 1", opened)
+	}
+}
+
+// exchangeFunc answers queries with its result.
+type exchangeFunc func(q []byte) []byte
+
+func (f exchangeFunc) Exchange(ctx context.Context, q []byte) ([]byte, error) { return f(q), nil }
+
+func TestResolver(t *testing.T) {
+	addr, n, stop := stub(t)
+	defer stop()
+	var d net.Dialer
+	udp := &Upstream{
+		Addr:         addr,
+		ListenPacket: func() (net.PacketConn, error) { return net.ListenPacket("udp", "127.0.0.1:0") },
+		Dial:         func(ctx context.Context, addr string) (net.Conn, error) { return d.DialContext(ctx, "tcp", addr) },
+	}
+	tcp := &Upstream{Addr: addr, Dial: udp.Dial}
+	hosts := map[string][]net.IP{"db.test": {net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}}
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		up     *Upstream
+		prefer Preference
+		host   string
+		want   string // addresses, or error
+	}{
+		{udp, PreferIPv4, "dual.test", "[192.0.2.2 2001:db8::2]"},
+		{udp, PreferIPv6, "Dual.Test.", "[2001:db8::2 192.0.2.2]"},
+		{tcp, IPv6Only, "dual.test", "[2001:db8::2]"},
+		{tcp, IPv4Only, "v4.test", "[192.0.2.1]"},
+		{udp, IPv6Only, "v4.test", "lookup v4.test: no suitable address"},
+		{udp, PreferIPv4, "missing.test", "lookup missing.test: no such host"},
+		{udp, PreferIPv6, "db.test", "[fd00::1 10.0.0.1]"},
+		{udp, IPv4Only, "192.0.2.9", "[192.0.2.9]"},
+	} {
+		r := NewResolver([]Exchanger{tt.up}, hosts, tt.prefer)
+		for i := 0; i < 2; i++ {
+			before := atomic.LoadInt32(n)
+			ips, err := r.LookupIP(ctx, tt.host)
+			got := fmt.Sprint(ips)
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.want {
+				t.Errorf("%s %v: got %s, want %s", tt.host, tt.prefer, got, tt.want)
+			}
+			if i == 1 && atomic.LoadInt32(n) != before {
+				t.Errorf("%s %v: not cached", tt.host, tt.prefer)
+			}
+		}
+	}
+	// responses not matching the query are not used nor cached
+	other, err := newQuery("dual.test", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, f := range map[string]exchangeFunc{
+		"ID": func(q []byte) []byte {
+			resp := stubAnswer(q)
+			resp[0] ^= 0xff
+			return resp
+		},
+		"question": func(q []byte) []byte {
+			resp := stubAnswer(other)
+			copy(resp, q[:2])
+			return resp
+		},
+	} {
+		r := NewResolver([]Exchanger{f}, nil, IPv4Only)
+		if ips, err := r.LookupIP(ctx, "v4.test"); err == nil {
+			t.Errorf("response with another %s: got %v", name, ips)
+		}
+		if resp := r.cache.get(cacheKey{"v4.test.", uint16(dnsmessage.TypeA), uint16(dnsmessage.ClassINET)}, 0); resp != nil {
+			t.Errorf("response with another %s cached", name)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeTTL is the TTL of fake addresses, short so that clients don't keep addresses reused
+// for other names.
+const fakeTTL = 1
+
+// FakeIP hands out addresses from a reserved IPv4 pool to names and tells the names back
+// from the addresses, e.g. to learn the name a redirected connection was made to. Addresses
+// are given in turn, reusing the oldest ones once all are taken. The mapping is kept in a
+// file, if any, to survive restarts.
+type FakeIP struct {
+	base uint32 // network address of the pool
+	size uint32 // number of addresses in the pool
+
+	mu    sync.Mutex
+	names map[uint32]string // by offset in the pool
+	offs  map[string]uint32 // by name
+	next  uint32            // offset of the next address to give
+	file  *os.File
+	lines int // in file
+}
+
+// NewFakeIP returns a FakeIP using the addresses of pool but its network and broadcast
+// addresses, such as 198.18.0.0/15, and keeping the mapping in the file at path unless empty.
+func NewFakeIP(pool string, path string) (*FakeIP, error) {
+	_, n, err := net.ParseCIDR(pool)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := n.Mask.Size()
+	if bits != 32 || ones < 8 || ones > 30 {
+		return nil, fmt.Errorf("invalid fake IP pool %s: want IPv4 from /8 to /30", pool)
+	}
+	f := &FakeIP{
+		base:  binary.BigEndian.Uint32(n.IP.To4()),
+		size:  1 << uint(bits-ones),
+		names: make(map[uint32]string),
+		offs:  make(map[string]uint32),
+		next:  1,
+	}
+	if path == "" {
+		return f, nil
+	}
+	if err := f.load(path); err != nil {
+		return nil, err
+	}
+	if f.lines > 2*len(f.names)+1024 {
+		if err := f.compact(path); err != nil {
+			return nil, err
+		}
+	}
+	if f.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// load reads the mapping from the file at path, made of "address name" lines in the order
+// they were given. Addresses out of the pool are skipped.
+func (f *FakeIP) load(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		f.lines++
+		p := strings.Fields(s.Text())
+		if len(p) != 2 {
+			continue
+		}
+		if off, ok := f.offset(net.ParseIP(p[0])); ok {
+			f.set(off, p[1])
+			f.next = f.after(off)
+		}
+	}
+	return s.Err()
+}
+
+// compact rewrites the file at path with only the current mapping.
+func (f *FakeIP) compact(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for i, off := uint32(0), f.next; i < f.size-2; i, off = i+1, f.after(off) {
+		if name, ok := f.names[off]; ok {
+			fmt.Fprintf(w, "%s %s\n", f.ip(off), name)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	f.lines = len(f.names)
+	return os.Rename(tmp.Name(), path)
+}
+
+// Close closes the file of the mapping.
+func (f *FakeIP) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// after returns the offset of the address given after off.
+func (f *FakeIP) after(off uint32) uint32 {
+	if off+1 >= f.size-1 {
+		return 1
+	}
+	return off + 1
+}
+
+func (f *FakeIP) offset(ip net.IP) (uint32, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0, false
+	}
+	off := binary.BigEndian.Uint32(ip4) - f.base
+	return off, off >= 1 && off < f.size-1
+}
+
+func (f *FakeIP) ip(off uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, f.base+off)
+	return ip
+}
+
+// set maps off and name to each other, dropping their previous mappings.
+func (f *FakeIP) set(off uint32, name string) {
+	if old, ok := f.names[off]; ok {
+		delete(f.offs, old)
+	}
+	if old, ok := f.offs[name]; ok {
+		delete(f.names, old)
+	}
+	f.names[off], f.offs[name] = name, off
+}
+
+// IP returns the address of name, in lower case without the final dot, giving it one if
+// it has none.
+func (f *FakeIP) IP(name string) net.IP {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off, ok := f.offs[name]; ok {
+		return f.ip(off)
+	}
+	off := f.next
+	f.next = f.after(off)
+	f.set(off, name)
+	ip := f.ip(off)
+	if f.file != nil {
+		// an error only loses the mapping on restart
+		fmt.Fprintf(f.file, "%s %s\n", ip, name)
+		f.lines++
+	}
+	return ip
+}
+
+// Name returns the name ip was given to, if any.
+func (f *FakeIP) Name(ip net.IP) (string, bool) {
+	off, ok := f.offset(ip)
+	if !ok {
+		return "", false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name, ok := f.names[off]
+	return name, ok
+}
+
+// Exchanger returns an Exchanger answering A queries with fake addresses and AAAA queries
+// with no address, so that clients use the fake ones. Other queries are passed to next.
+func (f *FakeIP) Exchanger(next Exchanger) Exchanger {
+	return &fakeExchanger{f, next}
+}
+
+type fakeExchanger struct {
+	f    *FakeIP
+	next Exchanger
+}
+
+func (x *fakeExchanger) Exchange(ctx context.Context, q []byte) ([]byte, error) {
+	h, question, err := parseQuestion(q)
+	if err != nil {
+		return nil, err
+	}
+	if question.Class != dnsmessage.ClassINET ||
+		question.Type != dnsmessage.TypeA && question.Type != dnsmessage.TypeAAAA {
+		return x.next.Exchange(ctx, q)
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(question)
+	if question.Type == dnsmessage.TypeA {
+		name := strings.TrimSuffix(strings.ToLower(question.Name.String()), ".")
+		var a dnsmessage.AResource
+		copy(a.A[:], x.f.IP(name))
+		b.StartAnswers()
+		rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: fakeTTL}
+		if err := b.AResource(rh, a); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
@@ -0,0 +1,180 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// cacheSize is the maximum number of responses cached by a Forwarder.
+const cacheSize = 4096
+
+// tcpIdleTimeout is how long a TCP client may wait between queries.
+const tcpIdleTimeout = 10 * time.Second
+
+// Forwarder answers DNS queries over UDP and TCP from its cache or an upstream chosen by
+// the queried name.
+type Forwarder struct {
+	// Logger logs verbose messages if not nil.
+	Logger Logger
+
+	mu    sync.RWMutex
+	route func(name string) Exchanger
+	cache *cache
+}
+
+// NewForwarder returns a Forwarder sending queries to the upstream returned by route for
+// the name, in lower case without the final dot.
+func NewForwarder(route func(name string) Exchanger) *Forwarder {
+	return &Forwarder{route: route, cache: newCache(cacheSize)}
+}
+
+// SetRoute changes the upstreams of new queries and empties the cache.
+func (f *Forwarder) SetRoute(route func(name string) Exchanger) {
+	c := newCache(cacheSize)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.route, f.cache = route, c
+}
+
+func (f *Forwarder) logf(format string, v ...interface{}) {
+	if f.Logger != nil {
+		f.Logger.Output(2, fmt.Sprintf(format, v...))
+	}
+}
+
+// Exchange answers q from the cache or its upstream.
+func (f *Forwarder) Exchange(ctx context.Context, q []byte) ([]byte, error) {
+	h, question, err := parseQuestion(q)
+	if err != nil {
+		return nil, err
+	}
+	if h.Response {
+		return nil, errors.New("dns: not a query")
+	}
+	name := strings.ToLower(question.Name.String())
+	key := cacheKey{name, uint16(question.Type), uint16(question.Class)}
+
+	f.mu.RLock()
+	route, c := f.route, f.cache
+	f.mu.RUnlock()
+	if resp := c.get(key, h.ID); resp != nil {
+		f.logf("DNS %s %v cached", name, question.Type)
+		return resp, nil
+	}
+	resp, err := route(strings.TrimSuffix(name, ".")).Exchange(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	f.logf("DNS %s %v", name, question.Type)
+	c.put(key, resp)
+	return resp, nil
+}
+
+// answer returns the response to q, a server failure if it can't be answered, or nil if q
+// is not a query.
+func (f *Forwarder) answer(ctx context.Context, q []byte) []byte {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	resp, err := f.Exchange(ctx, q)
+	if err == nil {
+		return resp
+	}
+	f.logf("DNS query failed: %v", err)
+	if h, err := header(q); err != nil || h.Response {
+		return nil
+	}
+	resp, err = reply(q, dnsmessage.Header{RecursionAvailable: true, RCode: dnsmessage.RCodeServerFailure})
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// maxPacketQueries bounds the queries over UDP answered at once, beyond which reading waits.
+const maxPacketQueries = 256
+
+// ServePacket answers queries read from pc until it is closed.
+func (f *Forwarder) ServePacket(pc net.PacketConn) error {
+	buf := make([]byte, 64*1024)
+	sem := make(chan struct{}, maxPacketQueries)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			f.logf("DNS read error: %v", err)
+			continue
+		}
+		q := append([]byte(nil), buf[:n]...)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem }()
+			if resp := f.answer(context.Background(), q); resp != nil {
+				pc.WriteTo(truncate(q, resp), addr)
+			}
+		}()
+	}
+}
+
+// truncate returns resp, or only its header and question with the TC flag set if it is
+// larger than the UDP payload size of the client: 512 bytes, or more as given by EDNS(0).
+func truncate(q, resp []byte) []byte {
+	max := 512
+	var p dnsmessage.Parser
+	if _, err := p.Start(q); err == nil && p.SkipAllQuestions() == nil && p.SkipAllAnswers() == nil &&
+		p.SkipAllAuthorities() == nil {
+		for {
+			h, err := p.AdditionalHeader()
+			if err != nil {
+				break
+			}
+			if h.Type == dnsmessage.TypeOPT && int(h.Class) > max {
+				max = int(h.Class)
+			}
+			if p.SkipAdditional() != nil {
+				break
+			}
+		}
+	}
+	if len(resp) <= max {
+		return resp
+	}
+	h, err := header(resp)
+	if err != nil {
+		return resp
+	}
+	h.Truncated = true
+	t, err := reply(resp, h)
+	if err != nil {
+		return resp
+	}
+	return t
+}
+
+// ServeConn answers queries over the TCP connection c until the client closes it or stays
+// idle, or ctx is done.
+func (f *Forwarder) ServeConn(ctx context.Context, c net.Conn) {
+	defer c.Close()
+	for ctx.Err() == nil {
+		c.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		q, err := readMsg(c)
+		if err != nil {
+			return
+		}
+		resp := f.answer(ctx, q)
+		if resp == nil {
+			return
+		}
+		if err := writeMsg(c, resp); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package dns
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var errShort = errors.New("dns: message too short")
+
+// newID returns an unpredictable message ID, as responses are matched to the query by it and
+// the question.
+func newID() (uint16, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(id[:]), nil
+}
+
+// header returns the header of msg.
+func header(msg []byte) (dnsmessage.Header, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return h, errShort
+	}
+	return h, nil
+}
+
+// parseQuestion returns the header and the first question of msg.
+func parseQuestion(msg []byte) (dnsmessage.Header, dnsmessage.Question, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return h, dnsmessage.Question{}, err
+	}
+	q, err := p.Question()
+	return h, q, err
+}
+
+// isResponse reports whether resp is a response to q, by ID and question.
+func isResponse(q, resp []byte) bool {
+	qh, qq, err := parseQuestion(q)
+	if err != nil {
+		return false
+	}
+	rh, rq, err := parseQuestion(resp)
+	if err == dnsmessage.ErrSectionDone {
+		return rh.Response && rh.ID == qh.ID // some errors have no question
+	}
+	// compare the question, case-insensitively as some servers randomize case
+	return err == nil && rh.Response && rh.ID == qh.ID && rq.Type == qq.Type && rq.Class == qq.Class &&
+		strings.EqualFold(rq.Name.String(), qq.Name.String())
+}
+
+// reply returns a response to q with the header fields of rh but the ID, opcode and RD flag
+// of q, its question if any and no records.
+func reply(q []byte, rh dnsmessage.Header) ([]byte, error) {
+	h, question, err := parseQuestion(q)
+	if err != nil && err != dnsmessage.ErrSectionDone {
+		return nil, err
+	}
+	rh.ID, rh.OpCode, rh.RecursionDesired, rh.Response = h.ID, h.OpCode, h.RecursionDesired, true
+	b := dnsmessage.NewBuilder(nil, rh)
+	b.StartQuestions()
+	if err == nil {
+		b.Question(question)
+	}
+	return b.Finish()
+}
@@ -0,0 +1,258 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Preference is the IP versions of the addresses returned by a Resolver, in order.
+type Preference int
+
+const (
+	PreferIPv4 Preference = iota // IPv4 then IPv6 addresses
+	PreferIPv6                   // IPv6 then IPv4 addresses
+	IPv4Only
+	IPv6Only
+)
+
+var preferenceNames = []string{"prefer-ipv4", "prefer-ipv6", "ipv4-only", "ipv6-only"}
+
+func (p Preference) String() string {
+	if int(p) < len(preferenceNames) {
+		return preferenceNames[p]
+	}
+	return "unknown"
+}
+
+// ParsePreference parses prefer-ipv4, prefer-ipv6, ipv4-only or ipv6-only.
+func ParsePreference(s string) (Preference, error) {
+	for i, name := range preferenceNames {
+		if strings.EqualFold(s, name) {
+			return Preference(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown IP preference %s", s)
+}
+
+// types returns the record types to query, in order.
+func (p Preference) types() []dnsmessage.Type {
+	switch p {
+	case PreferIPv6:
+		return []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	case IPv4Only:
+		return []dnsmessage.Type{dnsmessage.TypeA}
+	case IPv6Only:
+		return []dnsmessage.Type{dnsmessage.TypeAAAA}
+	}
+	return []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+}
+
+// Resolver looks up the addresses of names, first in a hosts file, then from DNS servers
+// with a cache of positive and negative answers kept for their TTL, or from the system
+// without cache if there are no servers.
+type Resolver struct {
+	upstreams []Exchanger
+	hosts     map[string][]net.IP
+	prefer    Preference
+	cache     *cache
+}
+
+// NewResolver returns a Resolver querying upstreams in turn until one answers, with hosts
+// overriding the addresses of names in lower case without the final dot, and returning
+// addresses as preferred.
+func NewResolver(upstreams []Exchanger, hosts map[string][]net.IP, prefer Preference) *Resolver {
+	return &Resolver{upstreams: upstreams, hosts: hosts, prefer: prefer, cache: newCache(cacheSize)}
+}
+
+// ReadHosts reads a file in the format of /etc/hosts: an IP address then names on each line.
+func ReadHosts(path string) (map[string][]net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hosts := make(map[string][]net.IP)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		p := strings.Fields(line)
+		if len(p) == 0 {
+			continue
+		}
+		ip := net.ParseIP(p[0])
+		if ip == nil || len(p) < 2 {
+			return nil, fmt.Errorf("%s:%d: want address and names", path, n)
+		}
+		for _, name := range p[1:] {
+			name = strings.TrimSuffix(strings.ToLower(name), ".")
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	return hosts, s.Err()
+}
+
+// LookupIP returns the addresses of host, or host itself if an IP address.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name := strings.TrimSuffix(strings.ToLower(host), ".")
+	var ips []net.IP
+	var err error
+	if h, ok := r.hosts[name]; ok {
+		for _, typ := range r.prefer.types() {
+			ips = append(ips, filter(h, typ)...)
+		}
+	} else if len(r.upstreams) == 0 {
+		var addrs []net.IPAddr
+		if addrs, err = net.DefaultResolver.LookupIPAddr(ctx, host); err == nil {
+			var all []net.IP
+			for _, a := range addrs {
+				all = append(all, a.IP)
+			}
+			for _, typ := range r.prefer.types() {
+				ips = append(ips, filter(all, typ)...)
+			}
+		}
+	} else {
+		// query the types at once
+		types := r.prefer.types()
+		found := make([][]net.IP, len(types))
+		errs := make([]error, len(types))
+		var wg sync.WaitGroup
+		for i, typ := range types {
+			wg.Add(1)
+			go func(i int, typ dnsmessage.Type) {
+				defer wg.Done()
+				found[i], errs[i] = r.lookup(ctx, name, typ)
+			}(i, typ)
+		}
+		wg.Wait()
+		for i := range types {
+			ips = append(ips, found[i]...)
+			if errs[i] != nil {
+				err = errs[i]
+			}
+		}
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no suitable address", Name: host, IsNotFound: true}
+	}
+	return nil, err
+}
+
+// filter returns the addresses of the version queried by typ.
+func filter(ips []net.IP, typ dnsmessage.Type) []net.IP {
+	var out []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (typ == dnsmessage.TypeA) {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// errServer is returned when no DNS server answers.
+var errServer = errors.New("dns: server failure")
+
+// lookup returns the addresses of name from the records of type typ, cached or queried.
+func (r *Resolver) lookup(ctx context.Context, name string, typ dnsmessage.Type) ([]net.IP, error) {
+	key := cacheKey{name + ".", uint16(typ), uint16(dnsmessage.ClassINET)}
+	resp := r.cache.get(key, 0)
+	if resp == nil {
+		q, err := newQuery(name, typ)
+		if err != nil {
+			return nil, err
+		}
+		err = errServer
+		for _, u := range r.upstreams {
+			if resp, err = u.Exchange(ctx, q); err == nil {
+				h, _ := header(resp)
+				if isResponse(q, resp) && (h.RCode == dnsmessage.RCodeSuccess || h.RCode == dnsmessage.RCodeNameError) {
+					break
+				}
+				resp, err = nil, errServer
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, &net.DNSError{Err: err.Error(), Name: name, IsTemporary: true}
+		}
+		r.cache.put(key, resp)
+	}
+	return answerIPs(resp, name, typ)
+}
+
+// newQuery returns a recursive query for the records of type typ of name.
+func newQuery(name string, typ dnsmessage.Type) ([]byte, error) {
+	n, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, err
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: n, Type: typ, Class: dnsmessage.ClassINET})
+	return b.Finish()
+}
+
+// answerIPs returns the addresses in the answer records of type typ of resp.
+func answerIPs(resp []byte, name string, typ dnsmessage.Type) ([]net.IP, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, err
+	}
+	if h.RCode == dnsmessage.RCodeNameError {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return ips, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case rh.Class != dnsmessage.ClassINET || rh.Type != typ:
+			err = p.SkipAnswer()
+		case typ == dnsmessage.TypeA:
+			var a dnsmessage.AResource
+			if a, err = p.AResource(); err == nil {
+				ips = append(ips, net.IP(a.A[:]))
+			}
+		default:
+			var a dnsmessage.AAAAResource
+			if a, err = p.AAAAResource(); err == nil {
+				ips = append(ips, net.IP(a.AAAA[:]))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -3,6 +3,9 @@ module github.com/shadowsocks/go-shadowsocks2
 go 1.16
 
 require (
+	github.com/oschwald/maxminddb-golang v1.8.0
 	github.com/riobard/go-bloom v0.0.0-20200614022211-cdc8013cb5b3
 	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
+	lukechampine.com/blake3 v1.1.7
 )
@@ -18,54 +18,129 @@ import (
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
-var config struct {
+// globalConfig holds settings that only take effect on restart.
+type globalConfig struct {
 	Verbose    bool
 	UDPTimeout time.Duration
 	TCPCork    bool
+	SocksDefer bool
+	Bind       bool
+	BindAddr   string
+	FakeIP     string
+	FakeIPFile string
+	Sniff      bool
 }
 
-func main() {
+var config globalConfig
+
+// options holds settings that can be changed by reloading the configuration.
+type options struct {
+	Client        stringsFlag
+	Server        string
+	Cipher        string
+	Key           string
+	Password      string
+	Keygen        int
+	Socks         string
+	HTTP          string
+	Mixed         string
+	Auth          stringsFlag
+	AuthFile      string
+	RedirTCP      string
+	RedirTCP6     string
+	RedirUDP      string
+	TProxy        string
+	TCPTun        string
+	UDPTun        string
+	UDPSocks      bool
+	UDP           bool
+	TCP           bool
+	Plugin        string
+	PluginOpts    string
+	Users         stringsFlag
+	Config        string
+	Grace         time.Duration
+	Policy        string
+	Probe         string
+	ProbeInterval time.Duration
+	Rules         string
+	ACL           string
+	GeoIP         string
+	Geosite       string
+
+	DNS              string
+	DNSUpstream      string
+	DNSTCP           bool
+	DNSDirect        string
+	DNSDirectDomains string
+
+	Resolver       string
+	ResolverHosts  string
+	ResolverPrefer string
+}
 
-	var flags struct {
-		Client     string
-		Server     string
-		Cipher     string
-		Key        string
-		Password   string
-		Keygen     int
-		Socks      string
-		RedirTCP   string
-		RedirTCP6  string
-		TCPTun     string
-		UDPTun     string
-		UDPSocks   bool
-		UDP        bool
-		TCP        bool
-		Plugin     string
-		PluginOpts string
-	}
+var flags options
+
+func main() {
 
+	flag.StringVar(&flags.Config, "config", "", "load configuration from JSON file (shadowsocks-libev config.json format); flags override file values; reloaded on SIGHUP")
 	flag.BoolVar(&config.Verbose, "verbose", false, "verbose mode")
 	flag.StringVar(&flags.Cipher, "cipher", "AEAD_CHACHA20_POLY1305", "available ciphers: "+strings.Join(core.ListCipher(), " "))
 	flag.StringVar(&flags.Key, "key", "", "base64url-encoded key (derive from password if empty)")
 	flag.IntVar(&flags.Keygen, "keygen", 0, "generate a base64url-encoded random key of given length in byte")
-	flag.StringVar(&flags.Password, "password", "", "password")
+	flag.StringVar(&flags.Password, "password", "", "password (base64-encoded key for 2022 ciphers)")
 	flag.StringVar(&flags.Server, "s", "", "server listen address or url")
-	flag.StringVar(&flags.Client, "c", "", "client connect address or url")
+	flag.Var(&flags.Client, "c", "client connect address or url (repeatable for multiple servers)")
+	flag.StringVar(&flags.Policy, "policy", "failover", "(client-only) server selection policy: failover, roundrobin, leastconn or latency")
+	flag.StringVar(&flags.Probe, "probe", "", "(client-only) health check servers by connecting through them to this address, e.g. host:80 of an HTTP server")
+	flag.DurationVar(&flags.ProbeInterval, "probe-interval", 30*time.Second, "(client-only) time between health checks")
+	flag.StringVar(&flags.Rules, "rules", "", "(client-only) route connections through the server, directly or nowhere by rules from this file")
+	flag.StringVar(&flags.GeoIP, "geoip", "", "(client-only) MaxMind MMDB country database for GEOIP rules")
+	flag.StringVar(&flags.Geosite, "geosite", "", "(client-only) directory of domain lists for GEOSITE rules, as in v2fly/domain-list-community")
 	flag.StringVar(&flags.Socks, "socks", "", "(client-only) SOCKS listen address")
-	flag.BoolVar(&flags.UDPSocks, "u", false, "(client-only) Enable UDP support for SOCKS")
+	flag.BoolVar(&config.SocksDefer, "socks-defer", false, "(client-only) reply to SOCKS connect requests once connected to the server, reporting failures")
+	flag.StringVar(&flags.HTTP, "http", "", "(client-only) HTTP proxy listen address")
+	flag.StringVar(&flags.Mixed, "mixed", "", "(client-only) SOCKS5, SOCKS4/4a and HTTP proxy listen address")
+	flag.Var(&flags.Auth, "auth", "(client-only) require SOCKS5 and HTTP proxy clients to log in as user:password (repeatable)")
+	flag.StringVar(&flags.AuthFile, "auth-file", "", "(client-only) file of user:password lines for -auth")
+	flag.BoolVar(&flags.UDPSocks, "u", false, "(client-only) Enable UDP support for SOCKS and mixed")
 	flag.StringVar(&flags.RedirTCP, "redir", "", "(client-only) redirect TCP from this address")
 	flag.StringVar(&flags.RedirTCP6, "redir6", "", "(client-only) redirect TCP IPv6 from this address")
+	flag.StringVar(&flags.TProxy, "tproxy", "", "(client-only) redirect TCP and TCP IPv6 sent here by TPROXY on Linux from this address")
+	flag.BoolVar(&config.Sniff, "sniff", false, "(client-only) relay TCP redirected by -redir, -redir6 and -tproxy to the name found in their TLS or HTTP requests")
+	flag.StringVar(&flags.RedirUDP, "redir-udp", "", "(client-only) redirect UDP sent here by TPROXY on Linux from this address")
+	flag.StringVar(&flags.DNS, "dns", "", "(client-only) DNS forwarder listen address for UDP and TCP, resolving through the server")
+	flag.StringVar(&flags.DNSUpstream, "dns-upstream", "8.8.8.8:53", "(client-only) DNS server reached through the server by -dns")
+	flag.BoolVar(&flags.DNSTCP, "dns-tcp", false, "(client-only) send DNS queries to -dns-upstream over TCP, for servers without UDP")
+	flag.StringVar(&flags.DNSDirect, "dns-direct", "", "(client-only) DNS server queried directly by -dns for -dns-direct-domains")
+	flag.StringVar(&flags.DNSDirectDomains, "dns-direct-domains", "", "(client-only) comma-separated domain suffixes, or geosite:NAME lists, resolved by -dns-direct")
+	flag.StringVar(&config.FakeIP, "fake-ip", "", "(client-only) answer -dns queries resolved through the server with addresses from this pool, e.g. 198.18.0.0/15, and redirect connections to them by name")
+	flag.StringVar(&config.FakeIPFile, "fake-ip-file", "", "(client-only) keep the names of -fake-ip addresses in this file across restarts")
 	flag.StringVar(&flags.TCPTun, "tcptun", "", "(client-only) TCP tunnel (laddr1=raddr1,laddr2=raddr2,...)")
 	flag.StringVar(&flags.UDPTun, "udptun", "", "(client-only) UDP tunnel (laddr1=raddr1,laddr2=raddr2,...)")
 	flag.StringVar(&flags.Plugin, "plugin", "", "Enable SIP003 plugin. (e.g., v2ray-plugin)")
 	flag.StringVar(&flags.PluginOpts, "plugin-opts", "", "Set SIP003 plugin options. (e.g., \"server;tls;host=mydomain.me\")")
+	flag.Var(&flags.Users, "user", "(server-only) accept a user given as name:cipher:password instead of a single password (repeatable)")
 	flag.BoolVar(&flags.UDP, "udp", false, "(server-only) enable UDP support")
 	flag.BoolVar(&flags.TCP, "tcp", true, "(server-only) enable TCP support")
+	flag.StringVar(&flags.ACL, "acl", "", "(server-only) connect only to targets allowed by rules from this file; loopback, link-local, private and other special addresses are always denied unless allowed by an IP rule")
+	flag.StringVar(&flags.Resolver, "resolver", "", "(server-only) comma-separated DNS servers resolving targets with a cache, as ip:port over UDP then TCP if truncated, or tcp://ip:port; the system resolver if empty")
+	flag.StringVar(&flags.ResolverHosts, "resolver-hosts", "", "(server-only) resolve target names in this file, in /etc/hosts format, first")
+	flag.StringVar(&flags.ResolverPrefer, "resolver-prefer", "", "(server-only) addresses of targets to connect to: prefer-ipv4 (default), prefer-ipv6, ipv4-only or ipv6-only")
+	flag.BoolVar(&config.Bind, "bind", false, "(server-only) let clients listen for connections on the server for SOCKS5 BIND")
+	flag.StringVar(&config.BindAddr, "bind-addr", "", "(server-only) IP address -bind listens on, e.g. the public address behind a plugin; the address clients connected to if empty, refusing BIND if loopback")
 	flag.BoolVar(&config.TCPCork, "tcpcork", false, "coalesce writing first few packets")
 	flag.DurationVar(&config.UDPTimeout, "udptimeout", 5*time.Minute, "UDP tunnel timeout")
+	flag.DurationVar(&flags.Grace, "grace", 10*time.Second, "time to let active connections finish on SIGINT or SIGTERM before closing them")
 	flag.Parse()
 
+	cmdline := flags
+	if flags.Config != "" {
+		if err := loadConfig(flags.Config, &flags, &config); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if flags.Keygen > 0 {
 		key := make([]byte, flags.Keygen)
 		io.ReadFull(rand.Reader, key)
@@ -73,135 +148,78 @@ func main() {
 		return
 	}
 
-	if flags.Client == "" && flags.Server == "" {
+	if len(flags.Client) == 0 && flags.Server == "" {
 		flag.Usage()
 		return
 	}
 
-	var key []byte
-	if flags.Key != "" {
-		k, err := base64.URLEncoding.DecodeString(flags.Key)
-		if err != nil {
-			log.Fatal(err)
-		}
-		key = k
+	socks.UDPEnabled = flags.UDPSocks
+	if err := apply(&flags); err != nil {
+		log.Fatal(err)
 	}
 
-	if flags.Client != "" { // client mode
-		addr := flags.Client
-		cipher := flags.Cipher
-		password := flags.Password
-		if flags.Password == "" {
-			password = os.Getenv("SS_PASSWORD")
-		}
-		var err error
-
-		if strings.HasPrefix(addr, "ss://") {
-			addr, cipher, password, err = parseURL(addr)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-
-		udpAddr := addr
-
-		ciph, err := core.PickCipher(cipher, key, password)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if flags.Plugin != "" {
-			addr, err = startPlugin(flags.Plugin, flags.PluginOpts, addr, false)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-
-		if flags.UDPTun != "" {
-			for _, tun := range strings.Split(flags.UDPTun, ",") {
-				p := strings.Split(tun, "=")
-				go udpLocal(p[0], udpAddr, p[1], ciph.PacketConn)
-			}
-		}
-
-		if flags.TCPTun != "" {
-			for _, tun := range strings.Split(flags.TCPTun, ",") {
-				p := strings.Split(tun, "=")
-				go tcpTun(p[0], addr, p[1], ciph.StreamConn)
-			}
-		}
-
-		if flags.Socks != "" {
-			socks.UDPEnabled = flags.UDPSocks
-			go socksLocal(flags.Socks, addr, ciph.StreamConn)
-			if flags.UDPSocks {
-				go udpSocksLocal(flags.Socks, udpAddr, ciph.PacketConn)
-			}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigCh {
+		if sig != syscall.SIGHUP {
+			break
 		}
+		reload(cmdline)
+	}
+	shutdown(flags.Grace)
+	killPlugin()
+}
 
-		if flags.RedirTCP != "" {
-			go redirLocal(flags.RedirTCP, addr, ciph.StreamConn)
-		}
+type ssURL struct {
+	addr, cipher, password string
+	plugin, pluginOpts     string
+}
 
-		if flags.RedirTCP6 != "" {
-			go redir6Local(flags.RedirTCP6, addr, ciph.StreamConn)
-		}
+// parseURL parses ss://cipher:password@host:port, with an optional SIP002 plugin parameter
+// such as ?plugin=v2ray-plugin;server.
+func parseURL(s string) (*ssURL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
 	}
 
-	if flags.Server != "" { // server mode
-		addr := flags.Server
-		cipher := flags.Cipher
-		password := flags.Password
-		if flags.Password == "" {
-			password = os.Getenv("SS_PASSWORD")
-		}
-		var err error
-
-		if strings.HasPrefix(addr, "ss://") {
-			addr, cipher, password, err = parseURL(addr)
-			if err != nil {
-				log.Fatal(err)
-			}
+	ss := &ssURL{addr: u.Host}
+	if u.User != nil {
+		ss.cipher = u.User.Username()
+		ss.password, _ = u.User.Password()
+	}
+	if p := strings.SplitN(u.Query().Get("plugin"), ";", 2); p[0] != "" {
+		ss.plugin = p[0]
+		if len(p) > 1 {
+			ss.pluginOpts = p[1]
 		}
+	}
+	return ss, nil
+}
 
-		udpAddr := addr
-
-		if flags.Plugin != "" {
-			addr, err = startPlugin(flags.Plugin, flags.PluginOpts, addr, true)
-			if err != nil {
-				log.Fatal(err)
-			}
+// userCipher returns a cipher identifying users given as name:cipher:password.
+func userCipher(list []string) (core.Cipher, error) {
+	var users []core.User
+	for _, s := range list {
+		p := strings.SplitN(s, ":", 3)
+		if len(p) != 3 {
+			return nil, fmt.Errorf("invalid user %q: want name:cipher:password", s)
 		}
-
-		ciph, err := core.PickCipher(cipher, key, password)
+		ciph, err := core.PickCipher(p[1], nil, p[2])
 		if err != nil {
-			log.Fatal(err)
-		}
-
-		if flags.UDP {
-			go udpRemote(udpAddr, ciph.PacketConn)
-		}
-		if flags.TCP {
-			go tcpRemote(addr, ciph.StreamConn)
+			return nil, fmt.Errorf("user %s: %v", p[0], err)
 		}
+		users = append(users, core.User{Name: p[0], Cipher: ciph})
 	}
-
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
-	killPlugin()
+	return core.UserCipher(users)
 }
 
-func parseURL(s string) (addr, cipher, password string, err error) {
-	u, err := url.Parse(s)
-	if err != nil {
-		return
-	}
+// stringsFlag collects the values of a flag given multiple times.
+type stringsFlag []string
 
-	addr = u.Host
-	if u.User != nil {
-		cipher = u.User.Username()
-		password, _ = u.User.Password()
-	}
-	return
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
 }
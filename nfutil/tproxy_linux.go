@@ -0,0 +1,115 @@
+package nfutil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// from linux/include/uapi/linux/in.h and in6.h
+const (
+	_IP_TRANSPARENT       = 19
+	_IP_RECVORIGDSTADDR   = 20
+	_IPV6_RECVORIGDSTADDR = 74
+	_IPV6_TRANSPARENT     = 75
+)
+
+// setTransparent sets IP_TRANSPARENT on the socket of a ListenConfig, letting it receive
+// packets redirected by TPROXY and bind to non-local addresses, and with origDst also
+// IP_RECVORIGDSTADDR for UDP. IPv6 sockets get both the IPv4 and IPv6 options for dual
+// stack.
+func setTransparent(origDst bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		opts := [][2]int{{syscall.SOL_IP, _IP_TRANSPARENT}}
+		if origDst {
+			opts = append(opts, [2]int{syscall.SOL_IP, _IP_RECVORIGDSTADDR})
+		}
+		if strings.HasSuffix(network, "6") {
+			opts = append(opts, [2]int{syscall.SOL_IPV6, _IPV6_TRANSPARENT})
+			if origDst {
+				opts = append(opts, [2]int{syscall.SOL_IPV6, _IPV6_RECVORIGDSTADDR})
+			}
+		}
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			for _, o := range opts {
+				if err != nil {
+					return
+				}
+				err = syscall.SetsockoptInt(int(fd), o[0], o[1], 1)
+			}
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// ListenTProxyTCP listens on addr for TCP connections redirected by the TPROXY target of
+// iptables, whose local address is the original destination. Requires CAP_NET_ADMIN.
+func ListenTProxyTCP(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: setTransparent(false)}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// ListenTProxyUDP listens on addr for UDP packets redirected by the TPROXY target of
+// iptables, to be read with ReadFromUDPOrigDst. Requires CAP_NET_ADMIN.
+func ListenTProxyUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: setTransparent(true)}
+	c, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+// ReadFromUDPOrigDst reads a packet from c of ListenTProxyUDP with its source and original
+// destination.
+func ReadFromUDPOrigDst(c *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error) {
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofSockaddrInet6))
+	n, oobn, _, src, err := c.ReadMsgUDP(b, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.SOL_IP && m.Header.Type == _IP_RECVORIGDSTADDR &&
+			len(m.Data) >= syscall.SizeofSockaddrInet4:
+			raw := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&m.Data[0]))
+			port := (*[2]byte)(unsafe.Pointer(&raw.Port)) // raw.Port is big-endian
+			dst = &net.UDPAddr{IP: append(net.IP(nil), raw.Addr[:]...), Port: int(port[0])<<8 | int(port[1])}
+		case m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == _IPV6_RECVORIGDSTADDR &&
+			len(m.Data) >= syscall.SizeofSockaddrInet6:
+			raw := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&m.Data[0]))
+			port := (*[2]byte)(unsafe.Pointer(&raw.Port))
+			dst = &net.UDPAddr{IP: append(net.IP(nil), raw.Addr[:]...), Port: int(port[0])<<8 | int(port[1])}
+		}
+	}
+	if dst == nil {
+		return 0, nil, nil, errors.New("no original destination of UDP packet")
+	}
+	return n, src, dst, nil
+}
+
+// ListenTransparentUDP opens a UDP socket bound to addr, which need not be local, to send
+// replies of redirected packets from their original destination. Requires CAP_NET_ADMIN.
+func ListenTransparentUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp6"
+	if addr.IP.To4() != nil {
+		network = "udp4"
+	}
+	lc := net.ListenConfig{Control: setTransparent(false)}
+	c, err := lc.ListenPacket(context.Background(), network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
@@ -10,7 +10,7 @@ import (
 	"time"
 )
 
-var pluginCmd *exec.Cmd
+var pluginCmds []*exec.Cmd
 
 func startPlugin(plugin, pluginOpts, ssAddr string, isServer bool) (newAddr string, err error) {
 	logf("starting plugin (%s) with option (%s)....", plugin, pluginOpts)
@@ -37,19 +37,23 @@ func startPlugin(plugin, pluginOpts, ssAddr string, isServer bool) (newAddr stri
 }
 
 func killPlugin() {
-	if pluginCmd != nil {
-		pluginCmd.Process.Signal(syscall.SIGTERM)
-		waitCh := make(chan struct{})
-		go func() {
-			pluginCmd.Wait()
-			close(waitCh)
-		}()
-		timeout := time.After(3 * time.Second)
-		select {
-		case <-waitCh:
-		case <-timeout:
-			pluginCmd.Process.Kill()
-		}
+	for _, pluginCmd := range pluginCmds {
+		stopPlugin(pluginCmd)
+	}
+}
+
+func stopPlugin(pluginCmd *exec.Cmd) {
+	pluginCmd.Process.Signal(syscall.SIGTERM)
+	waitCh := make(chan struct{})
+	go func() {
+		pluginCmd.Wait()
+		close(waitCh)
+	}()
+	timeout := time.After(3 * time.Second)
+	select {
+	case <-waitCh:
+	case <-timeout:
+		pluginCmd.Process.Kill()
 	}
 }
 
@@ -82,7 +86,7 @@ func execPlugin(plugin, pluginOpts, remoteHost, remotePort, localHost, localPort
 	if err = cmd.Start(); err != nil {
 		return err
 	}
-	pluginCmd = cmd
+	pluginCmds = append(pluginCmds, cmd)
 	go func() {
 		if err := cmd.Wait(); err != nil {
 			logf("plugin exited (%v)\n", err)
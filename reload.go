@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/dns"
+	"github.com/shadowsocks/go-shadowsocks2/route"
+	"github.com/shadowsocks/go-shadowsocks2/service"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// client and server relay new connections with the current configuration.
+var (
+	client *service.Client
+	server *service.Server
+)
+
+// databases are used by GEOIP and GEOSITE rules, opened from databasePaths and reloaded
+// when their files change until stopWatch.
+var (
+	databases     = &route.Databases{}
+	databasePaths [2]string
+	stopWatch     context.CancelFunc
+)
+
+// openDatabases returns the databases configured by o, newly opened if the paths changed.
+func openDatabases(o *options) (*route.Databases, error) {
+	if databasePaths == [2]string{o.GeoIP, o.Geosite} {
+		return databases, nil
+	}
+	dbs := &route.Databases{}
+	if o.GeoIP != "" {
+		g, err := route.OpenGeoIP(o.GeoIP)
+		if err != nil {
+			return nil, err
+		}
+		dbs.GeoIP = g
+	}
+	if o.Geosite != "" {
+		g, err := route.OpenGeosite(o.Geosite)
+		if err != nil {
+			dbs.Close()
+			return nil, err
+		}
+		dbs.Geosite = g
+	}
+	return dbs, nil
+}
+
+// useDatabases replaces the databases with dbs opened from the paths of o.
+func useDatabases(o *options, dbs *route.Databases) {
+	if dbs == databases {
+		return
+	}
+	if stopWatch != nil {
+		stopWatch()
+	}
+	databases.Close()
+	databases, databasePaths = dbs, [2]string{o.GeoIP, o.Geosite}
+	var ctx context.Context
+	ctx, stopWatch = context.WithCancel(context.Background())
+	go dbs.Watch(ctx, 10*time.Second, log.Printf)
+}
+
+// stopHealthCheck stops the running health check of the client servers, if any.
+var stopHealthCheck context.CancelFunc
+
+// listeners holds running listeners by description.
+var listeners = make(map[string]io.Closer)
+
+// pluginAddrs holds the local addresses of started SIP003 plugins by settings.
+var pluginAddrs = make(map[string]string)
+
+// plugin starts a SIP003 plugin for addr once and returns its local address. New plugins can
+// only be started before any listener, and used records the settings of the plugins in use.
+func plugin(name, opts, addr string, isServer bool, used map[string]bool) (string, error) {
+	settings := fmt.Sprintf("%s %q %s %v", name, opts, addr, isServer)
+	used[settings] = true
+	if a, ok := pluginAddrs[settings]; ok {
+		return a, nil
+	}
+	if client != nil || server != nil {
+		return "", fmt.Errorf("changing plugin settings requires restart")
+	}
+	a, err := startPlugin(name, opts, addr, isServer)
+	if err != nil {
+		return "", err
+	}
+	pluginAddrs[settings] = a
+	return a, nil
+}
+
+// endpoint is a server given by address or URL, with the settings of options for the
+// parts missing from the URL.
+type endpoint struct {
+	addr, cipher, password string
+	plugin, pluginOpts     string
+}
+
+func parseEndpoint(o *options, s string) (*endpoint, error) {
+	e := &endpoint{addr: s, cipher: o.Cipher, password: o.Password, plugin: o.Plugin, pluginOpts: o.PluginOpts}
+	if o.Password == "" {
+		e.password = os.Getenv("SS_PASSWORD")
+	}
+	if strings.HasPrefix(s, "ss://") {
+		u, err := parseURL(s)
+		if err != nil {
+			return nil, err
+		}
+		e.addr, e.cipher, e.password = u.addr, u.cipher, u.password
+		if u.plugin != "" {
+			e.plugin, e.pluginOpts = u.plugin, u.pluginOpts
+		}
+	}
+	return e, nil
+}
+
+// proxyUsers returns the passwords by user name of -auth and -auth-file.
+func proxyUsers(o *options) (map[string]string, error) {
+	lines := append([]string(nil), o.Auth...)
+	if o.AuthFile != "" {
+		b, err := ioutil.ReadFile(o.AuthFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				lines = append(lines, line)
+			}
+		}
+	}
+	users := make(map[string]string)
+	for n, line := range lines {
+		i := strings.IndexByte(line, ':')
+		if i <= 0 || i > 255 || len(line)-i-1 > 255 {
+			return nil, fmt.Errorf("invalid proxy user #%d: want user:password of up to 255 bytes each", n+1)
+		}
+		users[line[:i]] = line[i+1:]
+	}
+	return users, nil
+}
+
+// apply starts the listeners configured by o which are not running yet, closes running
+// listeners no longer configured, and swaps the servers and ciphers of new connections.
+// Nothing changes if o is invalid.
+func apply(o *options) (err error) {
+	var key []byte
+	if o.Key != "" {
+		k, err := base64.URLEncoding.DecodeString(o.Key)
+		if err != nil {
+			return err
+		}
+		key = k
+	}
+
+	policy, err := service.ParsePolicy(o.Policy)
+	if err != nil {
+		return err
+	}
+	dbs, err := openDatabases(o)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil && dbs != databases {
+			dbs.Close()
+		}
+	}()
+	var router *route.Router
+	if o.Rules != "" {
+		if router, err = route.Load(o.Rules, dbs); err != nil {
+			return err
+		}
+	}
+	users, err := proxyUsers(o)
+	if err != nil {
+		return err
+	}
+	var probe socks.Addr
+	if o.Probe != "" {
+		if probe = socks.ParseAddr(o.Probe); probe == nil {
+			return fmt.Errorf("invalid probe address %q", o.Probe)
+		}
+		if o.ProbeInterval <= 0 {
+			return fmt.Errorf("invalid probe interval %v", o.ProbeInterval)
+		}
+	}
+	for _, tun := range strings.Split(o.TCPTun+","+o.UDPTun, ",") {
+		if tun != "" && len(strings.Split(tun, "=")) != 2 {
+			return fmt.Errorf("invalid tunnel %q: want laddr=raddr", tun)
+		}
+	}
+
+	want := make(map[string]func() (io.Closer, error))
+	usedPlugins := make(map[string]bool)
+	var ups []service.Upstream
+	var serverCiph core.Cipher
+	var dnsRt func(string) dns.Exchanger
+	var acl *route.ACL
+	var res service.Resolver
+
+	if len(o.Client) > 0 { // client mode
+		for _, s := range o.Client {
+			e, err := parseEndpoint(o, s)
+			if err != nil {
+				return err
+			}
+
+			ciph, err := core.PickCipher(e.cipher, key, e.password)
+			if err != nil {
+				return err
+			}
+
+			addr := e.addr
+			if e.plugin != "" {
+				addr, err = plugin(e.plugin, e.pluginOpts, e.addr, false, usedPlugins)
+				if err != nil {
+					return err
+				}
+			}
+			ups = append(ups, service.Upstream{Addr: addr, UDPAddr: e.addr, Cipher: ciph})
+		}
+
+		if o.UDPTun != "" {
+			for _, tun := range strings.Split(o.UDPTun, ",") {
+				p := strings.Split(tun, "=")
+				want["UDP tunnel "+tun] = func() (io.Closer, error) {
+					return udpLocal(p[0], p[1])
+				}
+			}
+		}
+
+		if o.TCPTun != "" {
+			for _, tun := range strings.Split(o.TCPTun, ",") {
+				p := strings.Split(tun, "=")
+				want["TCP tunnel "+tun] = func() (io.Closer, error) { return tcpTun(p[0], p[1]) }
+			}
+		}
+
+		if o.HTTP != "" {
+			want["HTTP proxy "+o.HTTP] = func() (io.Closer, error) { return httpLocal(o.HTTP) }
+		}
+		if o.Socks != "" {
+			want["SOCKS proxy "+o.Socks] = func() (io.Closer, error) { return socksLocal(o.Socks) }
+			if o.UDPSocks {
+				want["UDP SOCKS proxy "+o.Socks] = func() (io.Closer, error) {
+					return udpSocksLocal(o.Socks)
+				}
+			}
+		}
+		if o.Mixed != "" {
+			want["mixed proxy "+o.Mixed] = func() (io.Closer, error) { return mixedLocal(o.Mixed) }
+			if o.UDPSocks {
+				want["UDP SOCKS proxy "+o.Mixed] = func() (io.Closer, error) {
+					return udpSocksLocal(o.Mixed)
+				}
+			}
+		}
+
+		if o.RedirTCP != "" {
+			want["TCP redirect "+o.RedirTCP] = func() (io.Closer, error) { return redirLocal(o.RedirTCP) }
+		}
+
+		if o.RedirTCP6 != "" {
+			want["TCP6 redirect "+o.RedirTCP6] = func() (io.Closer, error) { return redir6Local(o.RedirTCP6) }
+		}
+
+		if o.TProxy != "" {
+			want["TCP TPROXY redirect "+o.TProxy] = func() (io.Closer, error) { return tproxyLocal(o.TProxy) }
+		}
+
+		if o.RedirUDP != "" {
+			want["UDP redirect "+o.RedirUDP] = func() (io.Closer, error) { return redirUDPLocal(o.RedirUDP) }
+		}
+
+		if config.FakeIP != "" && o.DNS == "" {
+			return fmt.Errorf("fake IP without DNS forwarder")
+		}
+		if config.FakeIP != "" && fakeIP == nil {
+			if fakeIP, err = dns.NewFakeIP(config.FakeIP, config.FakeIPFile); err != nil {
+				return err
+			}
+		}
+		if o.DNS != "" {
+			if dnsRt, err = dnsRoute(o, dbs); err != nil {
+				return err
+			}
+			want["DNS forwarder "+o.DNS] = func() (io.Closer, error) { return dnsLocal(o.DNS) }
+		}
+	}
+
+	if o.Server != "" { // server mode
+		e, err := parseEndpoint(o, o.Server)
+		if err != nil {
+			return err
+		}
+
+		addr, udpAddr := e.addr, e.addr
+
+		if e.plugin != "" {
+			addr, err = plugin(e.plugin, e.pluginOpts, e.addr, true, usedPlugins)
+			if err != nil {
+				return err
+			}
+		}
+
+		var ciph core.Cipher
+		if len(o.Users) > 0 {
+			ciph, err = userCipher(o.Users)
+		} else {
+			ciph, err = core.PickCipher(e.cipher, key, e.password)
+		}
+		if err != nil {
+			return err
+		}
+		serverCiph = ciph
+
+		if config.BindAddr != "" && net.ParseIP(config.BindAddr) == nil {
+			return fmt.Errorf("invalid bind address: %q", config.BindAddr)
+		}
+		if o.ACL != "" {
+			if acl, err = route.LoadACL(o.ACL, dbs); err != nil {
+				return err
+			}
+		}
+		if res, err = serverResolver(o); err != nil {
+			return err
+		}
+
+		if o.UDP {
+			want["UDP server "+udpAddr] = func() (io.Closer, error) { return udpRemote(udpAddr) }
+		}
+		if o.TCP {
+			want["TCP server "+addr] = func() (io.Closer, error) { return tcpRemote(addr) }
+		}
+	}
+
+	for settings := range pluginAddrs {
+		if !usedPlugins[settings] {
+			return fmt.Errorf("changing plugin settings requires restart")
+		}
+	}
+
+	if len(ups) > 0 {
+		if client == nil {
+			client = service.NewClient(policy, ups...)
+			client.UDPTimeout = config.UDPTimeout
+			client.TCPCork = config.TCPCork
+			client.DeferReply = config.SocksDefer
+			client.Sniff = config.Sniff
+			if config.Verbose {
+				client.Logger = logger
+			}
+		} else {
+			client.SetUpstreams(policy, ups...)
+		}
+		client.SetRouter(router)
+		client.SetProxyUsers(users)
+	}
+	if dnsRt != nil {
+		if dnsForwarder == nil {
+			dnsForwarder = dns.NewForwarder(dnsRt)
+			if config.Verbose {
+				dnsForwarder.Logger = logger
+			}
+		} else {
+			dnsForwarder.SetRoute(dnsRt)
+		}
+	}
+	useDatabases(o, dbs)
+	// restart to check new servers right away
+	if stopHealthCheck != nil {
+		stopHealthCheck()
+		stopHealthCheck = nil
+	}
+	if client != nil && probe != nil {
+		var ctx context.Context
+		ctx, stopHealthCheck = context.WithCancel(context.Background())
+		go client.HealthCheck(ctx, probe, o.ProbeInterval)
+	}
+	if serverCiph != nil {
+		if server == nil {
+			server = service.NewServer(serverCiph)
+			server.UDPTimeout = config.UDPTimeout
+			server.TCPCork = config.TCPCork
+			server.Bind = config.Bind
+			server.BindAddr = config.BindAddr
+			if config.Verbose {
+				server.Logger = logger
+			}
+		} else {
+			server.SetCipher(serverCiph)
+		}
+		server.SetACL(acl)
+		server.SetResolver(res)
+	}
+
+	for name, l := range listeners {
+		if _, ok := want[name]; !ok {
+			logf("stopping %s", name)
+			l.Close()
+			delete(listeners, name)
+		}
+	}
+	var names []string
+	for name := range want {
+		if _, ok := listeners[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l, err := want[name]()
+		if err != nil {
+			logf("failed to start %s: %v", name, err)
+			continue
+		}
+		listeners[name] = l
+	}
+	return nil
+}
+
+// reload reads the configuration file again, on top of the options given on the command line.
+func reload(cmdline options) {
+	o := cmdline
+	c := config
+	if o.Config != "" {
+		if err := loadConfig(o.Config, &o, &c); err != nil {
+			log.Printf("reload failed: %v", err)
+			return
+		}
+	}
+	if c != config || o.UDPSocks != flags.UDPSocks {
+		log.Printf("changes to verbose, tcpcork, udptimeout, socks-defer, bind, bind-addr, fake-ip, sniff and -u require restart")
+	}
+	o.UDPSocks = flags.UDPSocks
+	if err := apply(&o); err != nil {
+		log.Printf("reload failed: %v", err)
+		return
+	}
+	flags = o
+	log.Printf("configuration reloaded")
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// freeAddr returns a local address to listen on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// echo serves connections writing back what they read, and returns its address.
+func echo(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// tunnel connects to tgt through the server at addr with password.
+func tunnel(addr, password, tgt string) (net.Conn, error) {
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, password)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c = ciph.StreamConn(c)
+	if _, err := c.Write(socks.ParseAddr(tgt)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// ping writes to c and reads the echo back.
+func ping(c net.Conn) error {
+	c.SetDeadline(time.Now().Add(time.Second))
+	if _, err := c.Write([]byte("ping")); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(c, make([]byte, 4))
+	return err
+}
+
+func TestReload(t *testing.T) {
+	setFlags(t)
+	dir := t.TempDir()
+	acl := filepath.Join(dir, "acl.txt")
+	if err := ioutil.WriteFile(acl, []byte("IP-CIDR,127.0.0.0/8,allow\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	addr, target := freeAddr(t), echo(t)
+	write := func(addr, password string) {
+		host, port, _ := net.SplitHostPort(addr)
+		s := `{"server": "` + host + `", "server_port": ` + port + `, "method": "AEAD_CHACHA20_POLY1305",
+			"password": "` + password + `", "acl": "` + acl + `"}`
+		if err := ioutil.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	works := func(addr, password string) bool {
+		c, err := tunnel(addr, password, target)
+		if err != nil {
+			return false
+		}
+		defer c.Close()
+		return ping(c) == nil
+	}
+
+	write(addr, "first")
+	flags = options{Config: path, TCP: true, Policy: "failover"}
+	cmdline := flags
+	if err := loadConfig(path, &flags, &config); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(&flags); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for name, l := range listeners {
+			l.Close()
+			delete(listeners, name)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		server.Shutdown(ctx)
+		server = nil
+	}()
+
+	active, err := tunnel(addr, "first", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	if err := ping(active); err != nil {
+		t.Fatal(err)
+	}
+	l := listeners["TCP server "+addr]
+
+	// unchanged listener is kept
+	reload(cmdline)
+	if len(listeners) != 1 || listeners["TCP server "+addr] != l {
+		t.Errorf("listener replaced: %v", listeners)
+	}
+
+	// new password for new connections only
+	write(addr, "second")
+	reload(cmdline)
+	if listeners["TCP server "+addr] != l {
+		t.Error("listener replaced on password change")
+	}
+	if !works(addr, "second") || works(addr, "first") {
+		t.Error("password not changed")
+	}
+	if err := ping(active); err != nil {
+		t.Errorf("active connection: %v", err)
+	}
+
+	// bad configuration changes nothing
+	if err := ioutil.WriteFile(path, []byte(`{"server": "127.0.0.1", "server_port": 1, "method": "nope"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reload(cmdline)
+	if len(listeners) != 1 || listeners["TCP server "+addr] != l || flags.Password != "second" {
+		t.Errorf("bad configuration applied: %v, %+v", listeners, flags)
+	}
+	if !works(addr, "second") {
+		t.Error("server broken by bad configuration")
+	}
+
+	// listener on a new address replaces the old one
+	moved := freeAddr(t)
+	write(moved, "second")
+	reload(cmdline)
+	if _, ok := listeners["TCP server "+moved]; len(listeners) != 1 || !ok {
+		t.Errorf("listener not moved: %v", listeners)
+	}
+	if !works(moved, "second") || works(addr, "second") {
+		t.Error("listener not moved")
+	}
+	if err := ping(active); err != nil {
+		t.Errorf("active connection: %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package route
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// ACL decides which targets a server connects to for its clients, protecting the network of
+// the server. An ACL file has rules in the format of a rules file with the actions allow and
+// deny, where SRC-IP-CIDR matches the address of the client and USER its name on a multi-user
+// server:
+//
+//	DST-PORT,25,deny
+//	DOMAIN-SUFFIX,internal.example.com,deny
+//	IP-CIDR,10.1.2.3/32,allow
+//	FINAL,allow
+//
+// Targets given by domain are checked again with each address the name resolves to, so that
+// IP rules also apply to them. Unless allowed by an IP rule, targets are denied if their
+// address is in one of the default ranges: loopback, link-local, private, unspecified,
+// benchmarking, documentation, multicast, reserved and broadcast, and the NAT64 and 6to4
+// ranges embedding IPv4 addresses. Allowing by any other rule or FINAL only lets the address
+// be checked. A nil ACL denies the default ranges only.
+type ACL struct {
+	rules []aclRule
+	final *bool
+}
+
+type aclRule struct {
+	match func(t *target) bool
+	ip    bool // needs the address of the target
+	allow bool
+}
+
+// defaultDenied are the ranges denied by default.
+var defaultDenied []*net.IPNet
+
+func init() {
+	for _, s := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+		"192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24",
+		"203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4", "::/128", "::1/128", "64:ff9b::/96",
+		"2002::/16", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, n, _ := net.ParseCIDR(s)
+		defaultDenied = append(defaultDenied, n)
+	}
+}
+
+// LoadACL reads an ACL from the file named path, using dbs for GEOIP and GEOSITE rules.
+func LoadACL(path string, dbs *Databases) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	a, err := ParseACL(f, dbs)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	return a, nil
+}
+
+// ParseACL reads an ACL from r in the format of an ACL file. dbs may be nil without GEOIP
+// and GEOSITE rules.
+func ParseACL(r io.Reader, dbs *Databases) (*ACL, error) {
+	if dbs == nil {
+		dbs = &Databases{}
+	}
+	a := &ACL{}
+	if err := parseLines(r, func(line string) error { return a.add(line, dbs) }); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func parseAllow(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "allow":
+		return true, nil
+	case "deny":
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown action %s", s)
+}
+
+func (a *ACL) add(line string, dbs *Databases) error {
+	f := splitRule(line)
+	typ := f[0]
+	if typ == "FINAL" || typ == "MATCH" {
+		if len(f) != 2 {
+			return fmt.Errorf("want %s,ACTION", typ)
+		}
+		allow, err := parseAllow(f[1])
+		if err != nil {
+			return err
+		}
+		a.final = &allow
+		return nil
+	}
+	if len(f) != 3 {
+		return fmt.Errorf("want TYPE,VALUE,ACTION")
+	}
+	allow, err := parseAllow(f[2])
+	if err != nil {
+		return err
+	}
+	match, err := matcher(typ, f[1], dbs)
+	if err != nil {
+		return err
+	}
+	ip := typ == "IP-CIDR" || typ == "IP-CIDR6" || typ == "GEOIP"
+	a.rules = append(a.rules, aclRule{match: match, ip: ip, allow: allow})
+	return nil
+}
+
+// Allow reports whether a server may connect to tgt for a client at src, by user if any.
+// ip is an address tgt resolves to if given by domain, or nil. Without an address, decided is
+// false unless tgt is denied by its name: then ask again with each address it resolves to and
+// connect only to the allowed ones.
+func (a *ACL) Allow(src net.Addr, user string, tgt socks.Addr, ip net.IP) (allow, decided bool) {
+	t := newTarget(src, user, tgt)
+	if t == nil {
+		return false, true
+	}
+	if t.ip == nil {
+		t.ip = ip
+	}
+	var rules []aclRule
+	if a != nil {
+		rules = a.rules
+	}
+	named := false // allowed by a rule not on the address, which is still checked
+	for _, r := range rules {
+		if named && !r.ip {
+			continue
+		}
+		if r.ip && t.ip == nil {
+			return false, false
+		}
+		if !r.match(t) {
+			continue
+		}
+		if !r.allow {
+			return false, true
+		}
+		if r.ip {
+			return true, true
+		}
+		named = true
+	}
+	if !named && a != nil && a.final != nil && !*a.final {
+		return false, true
+	}
+	if t.ip == nil {
+		return false, false
+	}
+	for _, n := range defaultDenied {
+		if n.Contains(t.ip) {
+			return false, true
+		}
+	}
+	return true, true
+}
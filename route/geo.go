@@ -0,0 +1,301 @@
+package route
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Databases are used by GEOIP and GEOSITE rules.
+type Databases struct {
+	GeoIP   *GeoIP
+	Geosite *Geosite
+}
+
+// Close closes the GeoIP database.
+func (d *Databases) Close() error {
+	if d.GeoIP == nil {
+		return nil
+	}
+	return d.GeoIP.Close()
+}
+
+// Watch reloads the databases when their files change, checking every interval until ctx
+// is done. Reload errors are passed to logf and keep the previous data.
+func (d *Databases) Watch(ctx context.Context, interval time.Duration, logf func(string, ...interface{})) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		if d.GeoIP != nil {
+			if ok, err := d.GeoIP.Reload(); err != nil {
+				logf("failed to reload GeoIP database: %v", err)
+			} else if ok {
+				logf("reloaded GeoIP database %s", d.GeoIP.path)
+			}
+		}
+		if d.Geosite != nil {
+			if ok, err := d.Geosite.Reload(); err != nil {
+				logf("failed to reload geosite lists: %v", err)
+			} else if ok {
+				logf("reloaded geosite lists %s", d.Geosite.dir)
+			}
+		}
+	}
+}
+
+// GeoIP looks up the country of IP addresses in a MaxMind MMDB country database.
+type GeoIP struct {
+	path string
+	mu   sync.RWMutex
+	db   *maxminddb.Reader
+	mod  time.Time
+}
+
+// OpenGeoIP opens the MMDB database file named path, e.g. GeoLite2-Country.mmdb.
+func OpenGeoIP(path string) (*GeoIP, error) {
+	g := &GeoIP{path: path}
+	if _, err := g.Reload(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Reload reopens the database if its file changed, and reports whether it did.
+func (g *GeoIP) Reload() (bool, error) {
+	fi, err := os.Stat(g.path)
+	if err != nil {
+		return false, err
+	}
+	g.mu.RLock()
+	same := fi.ModTime().Equal(g.mod)
+	g.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+
+	db, err := maxminddb.Open(g.path)
+	if err != nil {
+		return false, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.db != nil {
+		g.db.Close()
+	}
+	g.db, g.mod = db, fi.ModTime()
+	return true, nil
+}
+
+// Close closes the database. Country returns "" afterwards.
+func (g *GeoIP) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.db == nil {
+		return nil
+	}
+	err := g.db.Close()
+	g.db = nil
+	return err
+}
+
+// Country returns the ISO 3166-1 code of the country of ip in upper case, or "" if unknown.
+func (g *GeoIP) Country(ip net.IP) string {
+	var rec struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.db == nil || g.db.Lookup(ip, &rec) != nil {
+		return ""
+	}
+	if rec.Country.ISOCode != "" {
+		return rec.Country.ISOCode
+	}
+	return rec.RegisteredCountry.ISOCode
+}
+
+// Geosite holds domain lists in the text format of v2fly/domain-list-community: a directory
+// with a file per list named after it, where each line is a domain optionally prefixed by
+// domain:, full:, keyword:, regexp: or include: another list. Attributes such as @cn are
+// ignored.
+type Geosite struct {
+	dir   string
+	mu    sync.RWMutex
+	lists map[string]*domainList
+	mod   time.Time
+}
+
+type domainList struct {
+	domains  map[string]bool // domain and subdomains
+	full     map[string]bool
+	keywords []string
+	regexps  []*regexp.Regexp
+	includes []string
+}
+
+// OpenGeosite reads the domain lists in dir, e.g. the data directory of domain-list-community.
+func OpenGeosite(dir string) (*Geosite, error) {
+	g := &Geosite{dir: dir}
+	if _, err := g.Reload(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Reload reads the lists again if any file changed, and reports whether it did.
+func (g *Geosite) Reload() (bool, error) {
+	files, err := ioutil.ReadDir(g.dir)
+	if err != nil {
+		return false, err
+	}
+	var mod time.Time
+	for _, fi := range files {
+		if fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
+	}
+	g.mu.RLock()
+	same := mod.Equal(g.mod) && g.lists != nil
+	g.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+
+	lists := make(map[string]*domainList)
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		l, err := readDomainList(filepath.Join(g.dir, fi.Name()))
+		if err != nil {
+			return false, err
+		}
+		lists[strings.ToLower(fi.Name())] = l
+	}
+	for name, l := range lists {
+		for _, inc := range l.includes {
+			if lists[inc] == nil {
+				return false, fmt.Errorf("%s: include of unknown list %s", filepath.Join(g.dir, name), inc)
+			}
+		}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.lists, g.mod = lists, mod
+	return true, nil
+}
+
+func readDomainList(path string) (*domainList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l := &domainList{domains: make(map[string]bool), full: make(map[string]bool)}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		typ, v := "domain", fields[0] // the rest are attributes
+		if i := strings.IndexByte(v, ':'); i >= 0 {
+			typ, v = v[:i], v[i+1:]
+		}
+		switch typ {
+		case "domain":
+			l.domains[normDomain(v)] = true
+		case "full":
+			l.full[normDomain(v)] = true
+		case "keyword":
+			l.keywords = append(l.keywords, strings.ToLower(v))
+		case "regexp":
+			re, err := regexp.Compile(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			l.regexps = append(l.regexps, re)
+		case "include":
+			l.includes = append(l.includes, strings.ToLower(v))
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown type %s", path, n, typ)
+		}
+	}
+	return l, s.Err()
+}
+
+// Has reports whether there is a list named name.
+func (g *Geosite) Has(name string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.lists[strings.ToLower(name)] != nil
+}
+
+// Match reports whether the list named name contains host.
+func (g *Geosite) Match(name, host string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.match(strings.ToLower(name), normDomain(host), 0)
+}
+
+// match follows includes up to a depth limit against cycles.
+func (g *Geosite) match(name, host string, depth int) bool {
+	l := g.lists[name]
+	if l == nil || depth > 8 {
+		return false
+	}
+	if l.full[host] {
+		return true
+	}
+	for d := host; ; {
+		if l.domains[d] {
+			return true
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	for _, k := range l.keywords {
+		if strings.Contains(host, k) {
+			return true
+		}
+	}
+	for _, re := range l.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	for _, inc := range l.includes {
+		if g.match(inc, host, depth+1) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,278 @@
+// Package route decides whether client connections go through the server, directly to
+// their target or nowhere, by rules on their target and source.
+//
+// A rules file has one rule per line in the form TYPE,VALUE,ACTION, matched in order:
+//
+//	# comment
+//	DOMAIN,example.com,direct          exact domain
+//	DOMAIN-SUFFIX,example.com,direct   domain and its subdomains
+//	DOMAIN-KEYWORD,ads,reject          domain containing the keyword
+//	DOMAIN-REGEX,^ad[0-9]*\.,reject    domain matching the regular expression
+//	IP-CIDR,192.168.0.0/16,direct      IP address target in the range
+//	DST-PORT,25,reject                 target port or range such as 6000-7000
+//	SRC-IP-CIDR,10.0.0.5/32,direct     source address in the range
+//	USER,alice,direct                  user authenticated by the local proxy
+//	GEOIP,CN,direct                    IP address target in the country of a GeoIP database
+//	GEOSITE,cn,direct                  domain in a geosite list
+//	FINAL,proxy                        anything else
+//
+// Actions are proxy, direct and reject. Connections matching no rule are proxied. Domain
+// rules only match targets given by domain and IP rules only targets given by IP address,
+// as targets are not resolved.
+package route
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Action is what to do with a connection.
+type Action int
+
+const (
+	Proxy  Action = iota // relay through the server
+	Direct               // connect to the target directly
+	Reject               // close the connection
+)
+
+var actionNames = []string{"proxy", "direct", "reject"}
+
+func (a Action) String() string {
+	if int(a) < len(actionNames) {
+		return actionNames[a]
+	}
+	return "unknown"
+}
+
+func parseAction(s string) (Action, error) {
+	for i, name := range actionNames {
+		if strings.EqualFold(s, name) {
+			return Action(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown action %s", s)
+}
+
+// target is a connection to match against rules.
+type target struct {
+	host string // lower case domain without trailing dot, empty if given by IP address
+	ip   net.IP // nil if given by domain and not resolved
+	port int
+	src  net.IP // nil if unknown
+	user string
+}
+
+type rule struct {
+	match  func(t *target) bool
+	action Action
+}
+
+// Router matches connections against rules.
+type Router struct {
+	rules []rule
+	final Action
+}
+
+// Load reads rules from the file named path, using dbs for GEOIP and GEOSITE rules.
+func Load(path string, dbs *Databases) (*Router, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := Parse(f, dbs)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	return r, nil
+}
+
+// Parse reads rules from r in the format of a rules file. dbs may be nil without GEOIP and
+// GEOSITE rules.
+func Parse(r io.Reader, dbs *Databases) (*Router, error) {
+	if dbs == nil {
+		dbs = &Databases{}
+	}
+	rt := &Router{}
+	if err := parseLines(r, func(line string) error { return rt.add(line, dbs) }); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// parseLines calls add with each line of r but blank lines and comments.
+func parseLines(r io.Reader, add func(line string) error) error {
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := add(line); err != nil {
+			return fmt.Errorf("%d: %v", n, err)
+		}
+	}
+	return s.Err()
+}
+
+// splitRule splits a line into trimmed fields, with the type in upper case.
+func splitRule(line string) []string {
+	f := strings.Split(line, ",")
+	for i := range f {
+		f[i] = strings.TrimSpace(f[i])
+	}
+	f[0] = strings.ToUpper(f[0])
+	return f
+}
+
+func (rt *Router) add(line string, dbs *Databases) error {
+	f := splitRule(line)
+	typ := f[0]
+	if typ == "FINAL" || typ == "MATCH" {
+		if len(f) != 2 {
+			return fmt.Errorf("want %s,ACTION", typ)
+		}
+		a, err := parseAction(f[1])
+		if err != nil {
+			return err
+		}
+		rt.final = a
+		return nil
+	}
+	if len(f) != 3 {
+		return fmt.Errorf("want TYPE,VALUE,ACTION")
+	}
+	a, err := parseAction(f[2])
+	if err != nil {
+		return err
+	}
+	match, err := matcher(typ, f[1], dbs)
+	if err != nil {
+		return err
+	}
+	rt.rules = append(rt.rules, rule{match: match, action: a})
+	return nil
+}
+
+// matcher returns the match function of a rule of type typ with value v.
+func matcher(typ, v string, dbs *Databases) (func(t *target) bool, error) {
+	switch typ {
+	case "DOMAIN":
+		d := normDomain(v)
+		return func(t *target) bool { return t.host == d }, nil
+	case "DOMAIN-SUFFIX":
+		d := normDomain(v)
+		return func(t *target) bool {
+			return t.host == d || strings.HasSuffix(t.host, "."+d)
+		}, nil
+	case "DOMAIN-KEYWORD":
+		k := strings.ToLower(v)
+		return func(t *target) bool { return t.host != "" && strings.Contains(t.host, k) }, nil
+	case "DOMAIN-REGEX":
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, err
+		}
+		return func(t *target) bool { return t.host != "" && re.MatchString(t.host) }, nil
+	case "IP-CIDR", "IP-CIDR6":
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		return func(t *target) bool { return t.ip != nil && n.Contains(t.ip) }, nil
+	case "SRC-IP-CIDR":
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		return func(t *target) bool { return t.src != nil && n.Contains(t.src) }, nil
+	case "DST-PORT":
+		lo, hi, err := parsePorts(v)
+		if err != nil {
+			return nil, err
+		}
+		return func(t *target) bool { return lo <= t.port && t.port <= hi }, nil
+	case "USER":
+		return func(t *target) bool { return t.user == v }, nil
+	case "GEOIP":
+		g := dbs.GeoIP
+		if g == nil {
+			return nil, fmt.Errorf("GEOIP rule without GeoIP database")
+		}
+		cc := strings.ToUpper(v)
+		return func(t *target) bool { return t.ip != nil && g.Country(t.ip) == cc }, nil
+	case "GEOSITE":
+		g := dbs.Geosite
+		if g == nil {
+			return nil, fmt.Errorf("GEOSITE rule without geosite lists")
+		}
+		if !g.Has(v) {
+			return nil, fmt.Errorf("unknown geosite list %s", v)
+		}
+		return func(t *target) bool { return t.host != "" && g.Match(v, t.host) }, nil
+	}
+	return nil, fmt.Errorf("unknown rule type %s", typ)
+}
+
+// parsePorts parses a port or a range of ports such as 6000-7000.
+func parsePorts(s string) (lo, hi int, err error) {
+	from, to := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+	if lo, err = strconv.Atoi(from); err == nil {
+		hi, err = strconv.Atoi(to)
+	}
+	if err != nil || lo < 0 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port range %s", s)
+	}
+	return lo, hi, nil
+}
+
+func normDomain(s string) string {
+	return strings.TrimSuffix(strings.ToLower(s), ".")
+}
+
+// Match returns the action of the first rule matching a connection from src to tgt, made
+// by user if authenticated. src may be nil.
+func (rt *Router) Match(src net.Addr, user string, tgt socks.Addr) Action {
+	t := newTarget(src, user, tgt)
+	if t == nil {
+		return rt.final
+	}
+	for _, r := range rt.rules {
+		if r.match(t) {
+			return r.action
+		}
+	}
+	return rt.final
+}
+
+// newTarget returns the target of a connection from src to tgt by user, or nil if tgt is
+// invalid.
+func newTarget(src net.Addr, user string, tgt socks.Addr) *target {
+	host, port, err := net.SplitHostPort(tgt.String())
+	if err != nil {
+		return nil
+	}
+	t := &target{user: user}
+	t.port, _ = strconv.Atoi(port)
+	if t.ip = net.ParseIP(host); t.ip == nil {
+		t.host = normDomain(host)
+	}
+	switch a := src.(type) {
+	case *net.TCPAddr:
+		t.src = a.IP
+	case *net.UDPAddr:
+		t.src = a.IP
+	}
+	return t
+}
@@ -0,0 +1,197 @@
+package route
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const rules = `
+# comment
+DOMAIN,exact.example.com,reject
+DOMAIN-SUFFIX,Example.COM,direct
+DOMAIN-KEYWORD,tracker,reject
+DOMAIN-REGEX,^ad[0-9]+\.,reject
+IP-CIDR,192.168.0.0/16,direct
+IP-CIDR6,fd00::/8,direct
+DST-PORT,25,reject
+DST-PORT,6000-7000,direct
+SRC-IP-CIDR,10.0.0.5/32,direct
+USER,bob,reject
+FINAL,proxy
+`
+
+func TestMatch(t *testing.T) {
+	rt, err := Parse(strings.NewReader(rules), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	for _, tt := range []struct {
+		tgt  string
+		src  net.Addr
+		user string
+		want Action
+	}{
+		{"exact.example.com:443", src, "", Reject},
+		{"www.example.com.:443", src, "", Direct},
+		{"example.com:80", src, "", Direct},
+		{"notexample.com:80", src, "", Proxy},
+		{"a.tracker.net:80", src, "", Reject},
+		{"ad12.foo.net:80", src, "", Reject},
+		{"192.168.1.1:80", src, "", Direct},
+		{"[fd00::1]:80", src, "", Direct},
+		{"8.8.8.8:25", src, "", Reject},
+		{"8.8.8.8:6500", src, "", Direct},
+		{"8.8.8.8:53", &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 53}, "", Direct},
+		{"8.8.8.8:53", nil, "", Proxy},
+		{"8.8.8.8:53", nil, "bob", Reject},
+	} {
+		if got := rt.Match(tt.src, tt.user, socks.ParseAddr(tt.tgt)); got != tt.want {
+			t.Errorf("%s from %v: got %v, want %v", tt.tgt, tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, s := range []string{
+		"DOMAIN,example.com",
+		"DOMAIN,example.com,drop",
+		"IP-CIDR,300.0.0.0/8,direct",
+		"DST-PORT,7000-6000,direct",
+		"GEOFOO,x,direct",
+		"GEOSITE,cn,direct", // no geosite lists
+	} {
+		if _, err := Parse(strings.NewReader(s), nil); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestGeosite(t *testing.T) {
+	dir := t.TempDir()
+	for name, s := range map[string]string{
+		"cn":     "# comment\nexample.cn\nfull:www.example.org @cn\nkeyword:baidu\nregexp:^cdn[0-9]+\\.\ninclude:sub\n",
+		"sub":    "sub.example.net\n",
+		"google": "google.com\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g, err := OpenGeosite(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := Parse(strings.NewReader("GEOSITE,cn,direct\nGEOSITE,google,reject\n"), &Databases{Geosite: g})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tgt, want := range map[string]Action{
+		"a.example.cn:443":     Direct,
+		"www.example.org:443":  Direct,
+		"example.org:443":      Proxy,
+		"www.baidu.com:80":     Direct,
+		"cdn12.foo.com:80":     Direct,
+		"x.sub.example.net:80": Direct,
+		"mail.google.com:443":  Reject,
+		"1.2.3.4:443":          Proxy,
+	} {
+		if got := rt.Match(nil, "", socks.ParseAddr(tgt)); got != want {
+			t.Errorf("%s: got %v, want %v", tgt, got, want)
+		}
+	}
+	if _, err := Parse(strings.NewReader("GEOSITE,nope,direct"), &Databases{Geosite: g}); err == nil {
+		t.Error("unknown geosite list: no error")
+	}
+}
+
+func TestACL(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(`
+DST-PORT,25,deny
+DOMAIN-SUFFIX,internal.example.com,deny
+IP-CIDR,10.1.2.3/32,allow
+DOMAIN,metadata.example.com,allow
+USER,bob,deny
+`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	for _, tt := range []struct {
+		tgt     string
+		ip      string
+		user    string
+		allow   bool
+		decided bool
+	}{
+		{"8.8.8.8:25", "", "", false, true},
+		{"mail.example.org:25", "", "", false, true},
+		{"db.internal.example.com:443", "", "", false, true},
+		{"10.1.2.3:80", "", "", true, true},
+		{"8.8.8.8:80", "", "", true, true},
+		{"8.8.8.8:80", "", "bob", false, true},
+		{"127.0.0.1:80", "", "", false, true},
+		{"169.254.169.254:80", "", "", false, true},
+		{"[::ffff:10.0.0.1]:80", "", "", false, true},
+		{"[fe80::1]:80", "", "", false, true},
+		// names are decided by their addresses
+		{"example.org:80", "", "", false, false},
+		{"example.org:80", "93.184.216.34", "", true, true},
+		{"rebind.example.org:80", "127.0.0.1", "", false, true},
+		{"app.example.org:80", "10.1.2.3", "", true, true},
+		{"metadata.example.com:80", "", "", false, false}, // IP rule first
+		{"metadata.example.com:80", "169.254.169.254", "", false, true},
+		{"metadata.example.com:80", "93.184.216.34", "", true, true},
+		{"198.18.0.1:80", "", "", false, true},
+		{"224.0.0.251:5353", "", "", false, true},
+		{"255.255.255.255:9", "", "", false, true},
+		{"[ff02::1]:80", "", "", false, true},
+		{"240.0.0.1:80", "", "", false, true},
+		{"192.0.0.8:80", "", "", false, true},
+		{"192.0.2.1:80", "", "", false, true},
+		{"198.51.100.1:80", "", "", false, true},
+		{"203.0.113.1:80", "", "", false, true},
+		{"[64:ff9b::a00:1]:80", "", "", false, true}, // NAT64 of 10.0.0.1
+		{"[2002:a00:1::1]:80", "", "", false, true},  // 6to4 of 10.0.0.1
+		{"nat64.example.org:80", "64:ff9b::7f00:1", "", false, true},
+	} {
+		allow, decided := acl.Allow(src, tt.user, socks.ParseAddr(tt.tgt), net.ParseIP(tt.ip))
+		if allow != tt.allow || decided != tt.decided {
+			t.Errorf("%s (%s) by %q: got %v, %v, want %v, %v", tt.tgt, tt.ip, tt.user, allow, decided, tt.allow, tt.decided)
+		}
+	}
+
+	acl, err = ParseACL(strings.NewReader("IP-CIDR,192.168.0.0/16,allow\nFINAL,deny\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allow, decided := acl.Allow(src, "", socks.ParseAddr("192.168.1.1:80"), nil); !allow || !decided {
+		t.Error("allowed private range denied")
+	}
+	if allow, decided := acl.Allow(src, "", socks.ParseAddr("8.8.8.8:80"), nil); allow || !decided {
+		t.Error("FINAL,deny allowed 8.8.8.8")
+	}
+	acl, err = ParseACL(strings.NewReader("FINAL,allow\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []*ACL{acl, nil} {
+		if allow, _ := a.Allow(src, "", socks.ParseAddr("127.0.0.1:80"), nil); allow {
+			t.Errorf("%v allowed loopback", a)
+		}
+		if allow, decided := a.Allow(src, "", socks.ParseAddr("example.org:80"), nil); allow || decided {
+			t.Errorf("%v decided a name without its address", a)
+		}
+		if allow, _ := a.Allow(src, "", socks.ParseAddr("8.8.8.8:80"), nil); !allow {
+			t.Errorf("%v denied 8.8.8.8", a)
+		}
+	}
+	if _, err := ParseACL(strings.NewReader("DST-PORT,25,reject\n"), nil); err == nil {
+		t.Error("accepted action reject")
+	}
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// association is a SOCKS5 UDP associate request, whose UDP sessions end with the TCP
+// connection it was made on.
+type association struct {
+	ip       string
+	port     int // source port of the client, 0 if unknown
+	sessions map[natKey]bool
+	closed   bool
+}
+
+type natKey struct {
+	nm  *natmap
+	key string
+}
+
+// associate accepts UDP packets from the client of c until dissociate. The address of the
+// request tgt tells the source port the client sends from, if not 0. Its IP is ignored as
+// clients often don't know theirs, and the IP of c is used instead.
+func (cl *Client) associate(c net.Conn, tgt socks.Addr) *association {
+	a := &association{sessions: make(map[natKey]bool)}
+	a.ip, _, _ = net.SplitHostPort(c.RemoteAddr().String())
+	if _, port, err := net.SplitHostPort(tgt.String()); err == nil {
+		a.port, _ = strconv.Atoi(port)
+	}
+	cl.amu.Lock()
+	defer cl.amu.Unlock()
+	if cl.assocs == nil {
+		cl.assocs = make(map[string][]*association)
+	}
+	cl.assocs[a.ip] = append(cl.assocs[a.ip], a)
+	return a
+}
+
+// dissociate ends a and its UDP sessions.
+func (cl *Client) dissociate(a *association) {
+	cl.amu.Lock()
+	l := cl.assocs[a.ip]
+	for i := range l {
+		if l[i] == a {
+			l = append(l[:i], l[i+1:]...)
+			break
+		}
+	}
+	if len(l) == 0 {
+		delete(cl.assocs, a.ip)
+	} else {
+		cl.assocs[a.ip] = l
+	}
+	a.closed = true
+	sessions := a.sessions
+	a.sessions = nil
+	cl.amu.Unlock()
+
+	for s := range sessions {
+		if pc := s.nm.Del(s.key); pc != nil {
+			pc.Close()
+		}
+	}
+}
+
+// association returns the association of packets from src, preferring one with its port.
+func (cl *Client) association(src net.Addr) *association {
+	host, port, err := net.SplitHostPort(src.String())
+	if err != nil {
+		return nil
+	}
+	p, _ := strconv.Atoi(port)
+	cl.amu.Lock()
+	defer cl.amu.Unlock()
+	var found *association
+	for _, a := range cl.assocs[host] {
+		if a.port == p {
+			return a
+		}
+		if a.port == 0 && found == nil {
+			found = a
+		}
+	}
+	return found
+}
+
+// join adds the session under key in nm to a, or returns false if a has ended.
+func (cl *Client) join(a *association, nm *natmap, key string) bool {
+	cl.amu.Lock()
+	defer cl.amu.Unlock()
+	if a.closed {
+		return false
+	}
+	a.sessions[natKey{nm, key}] = true
+	return true
+}
+
+// fragTimeout is the reassembly timer of SOCKS5 UDP fragments. RFC 1928 requires at least 5
+// seconds.
+const fragTimeout = 5 * time.Second
+
+// reassembler puts fragmented SOCKS5 UDP packets back together by source, as described in
+// RFC 1928 section 7. It is not safe for concurrent use.
+type reassembler struct {
+	queues map[string]*fragQueue
+}
+
+type fragQueue struct {
+	pkt     []byte // target address of the first fragment and data so far
+	last    byte   // position of the last fragment
+	expires time.Time
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{queues: make(map[string]*fragQueue)}
+}
+
+// add queues the data of the fragment at position frag, with the high bit marking the end,
+// sent from src. pkt is the target address and data after RSV FRAG. Returns the reassembled
+// target address and payload after the last fragment, or nil. Fragments must arrive in
+// order: a gap or a lower position than the last abandons the queue, as does the timer
+// expiring. A datagram at position 0 is not fragmented: it abandons the queue of src and is
+// returned as is.
+func (r *reassembler) add(src string, frag byte, pkt []byte) ([]byte, error) {
+	if frag == 0 {
+		delete(r.queues, src)
+		return pkt, nil
+	}
+	tgt := socks.SplitAddr(pkt)
+	if tgt == nil {
+		return nil, errors.New("invalid target address")
+	}
+	data := pkt[len(tgt):]
+	now := time.Now()
+	pos := frag & 0x7f
+	q := r.queues[src]
+	if q != nil && (now.After(q.expires) || pos != q.last+1) {
+		delete(r.queues, src)
+		q = nil
+	}
+	if q == nil {
+		if pos != 1 {
+			return nil, nil
+		}
+		for k, q := range r.queues {
+			if now.After(q.expires) {
+				delete(r.queues, k)
+			}
+		}
+		q = &fragQueue{pkt: append([]byte(nil), tgt...), expires: now.Add(fragTimeout)}
+		r.queues[src] = q
+	}
+	if len(q.pkt)+len(data) > udpBufSize {
+		delete(r.queues, src)
+		return nil, nil
+	}
+	q.pkt = append(q.pkt, data...)
+	q.last = pos
+	if frag&0x80 == 0 {
+		return nil, nil
+	}
+	delete(r.queues, src)
+	return q.pkt, nil
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/route"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// SOCKS5 BIND through a server is requested with bindTarget as the target address, followed
+// by the address of the expected peer. The server replies with the address it listens on,
+// or bindFailed if it can't, then the address of the peer once connected, and relays the
+// connection. Servers without BIND support fail to resolve the target under .invalid and
+// close the connection, so the client can tell.
+var (
+	bindTarget = socks.ParseAddr("bind.shadowsocks.invalid:0")
+	bindFailed = socks.ParseAddr("0.0.0.0:0")
+)
+
+const (
+	// bindTimeout is how long BIND waits for the peer to connect.
+	bindTimeout = 2 * time.Minute
+
+	// bindReplyTimeout is how long a client waits for the server to listen.
+	bindReplyTimeout = 10 * time.Second
+)
+
+// errBind is returned by Client.socks for BIND requests.
+var errBind = errors.New("SOCKS BIND request")
+
+// bind serves a SOCKS5 BIND request on c for a connection from peer, listening on a server
+// or locally as routed by the rules.
+func (cl *Client) bind(ctx context.Context, c net.Conn, user string, peer socks.Addr, reply func(error, socks.Addr) error) {
+	name := c.RemoteAddr().String()
+	if user != "" {
+		name = user + "@" + name
+	}
+	switch cl.route(c.RemoteAddr(), user, peer) {
+	case route.Reject:
+		cl.logf("reject BIND %s <- %s", name, peer)
+		reply(socks.ErrConnectionNotAllowed, nil)
+		return
+	case route.Direct:
+		host, _, _ := net.SplitHostPort(c.LocalAddr().String())
+		rc, err := acceptPeer(ctx, host, peer, func(bound socks.Addr) error { return reply(nil, bound) })
+		if err != nil {
+			cl.logf("failed to BIND: %v", err)
+			reply(socksError(err), nil)
+			return
+		}
+		defer rc.Close()
+		if err := reply(nil, socks.ParseAddr(rc.RemoteAddr().String())); err != nil {
+			return
+		}
+		cl.logf("direct BIND %s <-> %s", name, rc.RemoteAddr())
+		if err := relay(ctx, rc, c); err != nil {
+			cl.logf("relay error: %v", err)
+		}
+		return
+	}
+
+	p := cl.getPool()
+	m, rc, err := cl.connect(ctx, p)
+	if err != nil {
+		cl.logf("failed to BIND: %v", err)
+		reply(socksError(err), nil)
+		return
+	}
+	defer p.release(m)
+	defer rc.Close()
+	sc := m.Cipher.StreamConn(rc)
+	if _, err := sc.Write(append(append([]byte(nil), bindTarget...), peer...)); err != nil {
+		cl.logf("failed to send BIND request: %v", err)
+		reply(socks.ErrGeneralFailure, nil)
+		return
+	}
+	sc.SetReadDeadline(time.Now().Add(bindReplyTimeout))
+	bound, err := socks.ReadAddr(sc)
+	if err != nil {
+		cl.logf("server %s does not support BIND: %v", m.Addr, err)
+		reply(socks.ErrCommandNotSupported, nil)
+		return
+	}
+	if bytes.Equal(bound, bindFailed) {
+		cl.logf("failed to BIND on server %s", m.Addr)
+		reply(socks.ErrGeneralFailure, nil)
+		return
+	}
+	sc.SetReadDeadline(time.Time{})
+	if err := reply(nil, bound); err != nil {
+		return
+	}
+	from, err := socks.ReadAddr(sc)
+	if err != nil {
+		cl.logf("failed to BIND on server %s: %v", m.Addr, err)
+		reply(socks.ErrGeneralFailure, nil)
+		return
+	}
+	if err := reply(nil, from); err != nil {
+		return
+	}
+	cl.logf("BIND %s <-> %s <-> %s", name, m.Addr, from)
+	err = relay(ctx, sc, c)
+	if err != nil {
+		cl.logf("relay error: %v", err)
+	}
+	p.result(m, err)
+}
+
+// bind serves a BIND request on sc, whose underlying connection is c, following bindTarget.
+func (s *Server) bind(ctx context.Context, c, sc net.Conn) {
+	peer, err := socks.ReadAddr(sc)
+	if err != nil {
+		s.logf("failed to get BIND peer address from %v: %v", c.RemoteAddr(), err)
+		return
+	}
+	// listen where the client reached the server unless set, but not on loopback as behind
+	// a plugin, where the peer can't connect
+	host := s.BindAddr
+	if host == "" {
+		host, _, _ = net.SplitHostPort(c.LocalAddr().String())
+		if ip := net.ParseIP(host); ip == nil || ip.IsLoopback() {
+			s.logf("refuse BIND from %s: no address to listen on but %s", peerName(sc), host)
+			sc.Write(bindFailed)
+			return
+		}
+	}
+	replied := false
+	rc, err := acceptPeer(ctx, host, peer, func(bound socks.Addr) error {
+		replied = true
+		_, err := sc.Write(bound)
+		return err
+	})
+	if err != nil {
+		s.logf("failed to BIND: %v", err)
+		if !replied {
+			sc.Write(bindFailed)
+		}
+		return
+	}
+	defer rc.Close()
+	if _, err := sc.Write(socks.ParseAddr(rc.RemoteAddr().String())); err != nil {
+		return
+	}
+	s.logf("BIND %s <-> %s", peerName(sc), rc.RemoteAddr())
+	if err := relay(ctx, sc, rc); err != nil {
+		s.logf("relay error: %v", err)
+	}
+}
+
+// isBind reports whether tgt requests BIND.
+func isBind(tgt socks.Addr) bool {
+	return bytes.Equal(tgt, bindTarget)
+}
+
+// acceptPeer listens on host, calls bound with the listening address and returns the first
+// connection from peer within bindTimeout. Connections from anywhere are accepted if the IP
+// of peer is unspecified or peer is a domain name.
+func acceptPeer(ctx context.Context, host string, peer socks.Addr, bound func(socks.Addr) error) (net.Conn, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	if err := bound(socks.ParseAddr(l.Addr().String())); err != nil {
+		return nil, err
+	}
+
+	var ip net.IP
+	if h, _, err := net.SplitHostPort(peer.String()); err == nil {
+		ip = net.ParseIP(h)
+	}
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(bindTimeout))
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-stop:
+		}
+	}()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if ip == nil || ip.IsUnspecified() || ip.Equal(c.RemoteAddr().(*net.TCPAddr).IP) {
+			return c, nil
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,761 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/route"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Upstream is a Shadowsocks server used by a Client.
+type Upstream struct {
+	Addr    string // TCP address of the server, or of a SIP003 plugin in front of it
+	UDPAddr string // UDP address of the server; Addr if empty
+	Cipher  core.Cipher
+}
+
+func (up *Upstream) udpAddr() string {
+	if up.UDPAddr != "" {
+		return up.UDPAddr
+	}
+	return up.Addr
+}
+
+// Client relays connections and packets from local programs through Shadowsocks servers.
+// A server failing to connect, to decrypt repeatedly or a health check is marked down and
+// retried with exponential backoff.
+type Client struct {
+	// DialContext connects to the server. Uses net.Dialer if nil.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// UDPTimeout is how long idle UDP sessions are kept. Defaults to 5 minutes.
+	UDPTimeout time.Duration
+
+	// TCPCork coalesces writing the first few packets of each connection.
+	TCPCork bool
+
+	// DeferReply delays the reply to SOCKS connect requests until connected to the server,
+	// or to the target if direct, to report failures and the bound address. Otherwise
+	// success is replied right away, letting clients send data while connecting.
+	DeferReply bool
+
+	// Sniff makes ServeRedirect look for the names of connections in TLS and HTTP requests.
+	Sniff bool
+
+	// Logger logs verbose messages if not nil.
+	Logger Logger
+
+	mu     sync.RWMutex
+	pool   *pool
+	router *route.Router
+	users  map[string]string
+	t      tracker
+
+	amu    sync.Mutex
+	assocs map[string][]*association // by client IP
+}
+
+// NewClient returns a Client relaying through ups, picked by policy.
+func NewClient(policy Policy, ups ...Upstream) *Client {
+	return &Client{pool: newPool(policy, ups)}
+}
+
+// SetUpstreams changes the servers of new connections and UDP sessions. Established ones
+// keep the server they started with.
+func (cl *Client) SetUpstreams(policy Policy, ups ...Upstream) {
+	p := newPool(policy, ups)
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.pool = p
+}
+
+// SetRouter changes the rules deciding how new connections and UDP sessions are relayed.
+// All go through the servers if r is nil.
+func (cl *Client) SetRouter(r *route.Router) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.router = r
+}
+
+func (cl *Client) route(src net.Addr, user string, tgt socks.Addr) route.Action {
+	cl.mu.RLock()
+	r := cl.router
+	cl.mu.RUnlock()
+	if r == nil {
+		return route.Proxy
+	}
+	return r.Match(src, user, tgt)
+}
+
+// SetProxyUsers changes the passwords by user name required from new SOCKS5 and HTTP proxy
+// connections. No authentication is required if users is empty, otherwise SOCKS4 is refused.
+func (cl *Client) SetProxyUsers(users map[string]string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.users = users
+}
+
+// auth returns the function checking proxy users, or nil if not required.
+func (cl *Client) auth() func(user, password string) bool {
+	cl.mu.RLock()
+	users := cl.users
+	cl.mu.RUnlock()
+	if len(users) == 0 {
+		return nil
+	}
+	return func(user, password string) bool {
+		want, ok := users[user]
+		return ok && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+	}
+}
+
+// socks performs the SOCKS handshake on c. The reply to bind and UDP associate requests, and
+// to connect requests if DeferReply is set, is left to the returned function.
+func (cl *Client) socks(c net.Conn) (socks.Addr, string, func(error, socks.Addr) error, error) {
+	r, err := socks.ReadRequest(c, cl.auth())
+	if err != nil {
+		return nil, "", nil, err
+	}
+	reply := func(err error, bound socks.Addr) error { return r.Reply(c, err, bound) }
+	switch {
+	case r.Cmd == socks.CmdBind:
+		return r.Addr, r.User, reply, errBind
+	case r.Cmd == socks.CmdUDPAssociate:
+		return r.Addr, r.User, reply, socks.InfoUDPAssociate
+	case cl.DeferReply:
+		return r.Addr, r.User, reply, nil
+	}
+	return r.Addr, r.User, nil, reply(nil, nil)
+}
+
+func (cl *Client) getPool() *pool {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.pool
+}
+
+func (cl *Client) logf(f string, v ...interface{}) {
+	if cl.Logger != nil {
+		cl.Logger.Output(2, fmt.Sprintf(f, v...))
+	}
+}
+
+func (cl *Client) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if cl.DialContext != nil {
+		return cl.DialContext(ctx, network, addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+func (cl *Client) udpTimeout() time.Duration {
+	if cl.UDPTimeout > 0 {
+		return cl.UDPTimeout
+	}
+	return 5 * time.Minute
+}
+
+// Serve accepts SOCKS5 and SOCKS4/4a connections on l and proxies them through the server.
+// It returns when l is closed, with ErrServerClosed after Shutdown.
+func (cl *Client) Serve(l net.Listener) error {
+	return cl.t.serve(l, cl.logf, func(ctx context.Context, c net.Conn) {
+		cl.handle(ctx, c, cl.socks)
+	})
+}
+
+// ServeTunnel accepts connections on l and proxies them to tgt through the server.
+func (cl *Client) ServeTunnel(l net.Listener, tgt socks.Addr) error {
+	return cl.ServeFunc(l, func(net.Conn) (socks.Addr, error) { return tgt, nil })
+}
+
+// ServeConn accepts connections on l and handles them with handle, e.g. queries of a local
+// DNS server, so that Shutdown waits for them like for proxied connections. The context
+// is cancelled when Shutdown gives up waiting. It returns when l is closed, with
+// ErrServerClosed after Shutdown.
+func (cl *Client) ServeConn(l net.Listener, handle func(context.Context, net.Conn)) error {
+	return cl.t.serve(l, cl.logf, handle)
+}
+
+// ServeFunc accepts connections on l and proxies them through the server to the target
+// returned by getAddr, e.g. the original destination of redirected connections.
+func (cl *Client) ServeFunc(l net.Listener, getAddr func(net.Conn) (socks.Addr, error)) error {
+	return cl.t.serve(l, cl.logf, func(ctx context.Context, c net.Conn) {
+		cl.handle(ctx, c, func(c net.Conn) (socks.Addr, string, func(error, socks.Addr) error, error) {
+			tgt, err := getAddr(c)
+			return tgt, "", nil, err
+		})
+	})
+}
+
+// ServeMixed accepts SOCKS5, SOCKS4/4a and HTTP proxy connections on l, told apart by their
+// first byte, and proxies them through the server.
+func (cl *Client) ServeMixed(l net.Listener) error {
+	return cl.t.serve(l, cl.logf, func(ctx context.Context, c net.Conn) {
+		br := bufio.NewReader(c)
+		b, err := br.Peek(1)
+		if err != nil {
+			return
+		}
+		if b[0] == 4 || b[0] == 5 {
+			cl.handle(ctx, &bufConn{c, br}, cl.socks)
+		} else {
+			cl.serveHTTP(ctx, c, br)
+		}
+	})
+}
+
+// handle proxies c to the target returned by getAddr, with the user it authenticated. The
+// reply returned by getAddr, if any, is called with the result of connecting.
+func (cl *Client) handle(ctx context.Context, c net.Conn, getAddr func(net.Conn) (socks.Addr, string, func(error, socks.Addr) error, error)) {
+	tgt, user, reply, err := getAddr(c)
+	if err == errBind {
+		cl.bind(ctx, c, user, tgt, reply)
+		return
+	}
+	if err != nil {
+
+		// UDP: keep the connection until disconnect then free the UDP socket
+		if err == socks.InfoUDPAssociate {
+			a := cl.associate(c, tgt)
+			defer cl.dissociate(a)
+			if err := reply(nil, socks.ParseAddr(c.LocalAddr().String())); err != nil {
+				return
+			}
+			buf := make([]byte, 1)
+			// block here
+			for {
+				_, err := c.Read(buf)
+				if err, ok := err.(net.Error); ok && err.Timeout() {
+					continue
+				}
+				cl.logf("UDP Associate End.")
+				return
+			}
+		}
+
+		cl.logf("failed to get target address: %v", err)
+		return
+	}
+
+	rc, finish, err := cl.dialTarget(ctx, c.RemoteAddr(), user, tgt)
+	if err != nil {
+		if reply != nil {
+			reply(socksError(err), nil)
+		}
+		return
+	}
+	if reply != nil {
+		if err := reply(nil, socks.ParseAddr(rc.LocalAddr().String())); err != nil {
+			finish(nil)
+			return
+		}
+	}
+	err = relay(ctx, rc, c)
+	if err != nil {
+		cl.logf("relay error: %v", err)
+	}
+	finish(err)
+}
+
+// errRejected is returned by dialTarget for targets rejected by the rules.
+var errRejected = errors.New("rejected by rules")
+
+// socksError returns the SOCKS reply to a failure of dialTarget.
+func socksError(err error) socks.Error {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == errRejected:
+		return socks.ErrConnectionNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks.ErrConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks.ErrNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return socks.ErrHostUnreachable
+	}
+	return socks.ErrGeneralFailure
+}
+
+// dialTarget connects to tgt for a connection from src by user, if authenticated, through a
+// server or directly as routed by the rules. finish closes rc and records the error ending
+// the relay, if any.
+func (cl *Client) dialTarget(ctx context.Context, src net.Addr, user string, tgt socks.Addr) (rc net.Conn, finish func(error), err error) {
+	name := src.String()
+	if user != "" {
+		name = user + "@" + name
+	}
+	switch cl.route(src, user, tgt) {
+	case route.Reject:
+		cl.logf("reject %s -> %s", name, tgt)
+		return nil, nil, errRejected
+	case route.Direct:
+		rc, err := cl.dial(ctx, "tcp", tgt.String())
+		if err != nil {
+			cl.logf("failed to connect to %s: %v", tgt, err)
+			return nil, nil, err
+		}
+		cl.logf("direct %s <-> %s", name, tgt)
+		return rc, func(error) { rc.Close() }, nil
+	}
+
+	sc, server, finish, err := cl.dialProxy(ctx, tgt)
+	if err != nil {
+		return nil, nil, err
+	}
+	cl.logf("proxy %s <-> %s <-> %s", name, server, tgt)
+	return sc, finish, nil
+}
+
+// dialProxy connects to tgt through a server, returning its address.
+func (cl *Client) dialProxy(ctx context.Context, tgt socks.Addr) (sc net.Conn, server string, finish func(error), err error) {
+	p := cl.getPool()
+	m, rc, err := cl.connect(ctx, p)
+	if err != nil {
+		cl.logf("failed to connect to %s: %v", tgt, err)
+		return nil, "", nil, err
+	}
+	if cl.TCPCork {
+		rc = timedCork(rc, 10*time.Millisecond, 1280)
+	}
+	sc, err = core.Connect(ctx, m.Cipher.StreamConn(rc), tgt)
+	if err != nil {
+		rc.Close()
+		p.release(m)
+		cl.logf("failed to send target address: %v", err)
+		return nil, "", nil, err
+	}
+	return sc, m.Addr, func(err error) {
+		sc.Close()
+		p.release(m)
+		if p.result(m, err) {
+			cl.logf("server %s marked down after repeated decryption errors", m.Addr)
+		}
+	}, nil
+}
+
+// Dial connects to tgt through a server whatever the rules, for use by other services of
+// the client such as its DNS forwarder.
+func (cl *Client) Dial(ctx context.Context, tgt socks.Addr) (net.Conn, error) {
+	sc, _, finish, err := cl.dialProxy(ctx, tgt)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: sc, finish: finish}, nil
+}
+
+// proxyConn is a connection returned by Dial.
+type proxyConn struct {
+	net.Conn
+	finish func(error)
+	once   sync.Once
+}
+
+func (pc *proxyConn) Close() error {
+	pc.once.Do(func() { pc.finish(nil) })
+	return nil
+}
+
+// connect dials a server picked from p, trying the others if it fails. Returns the last
+// dial error if all fail.
+func (cl *Client) connect(ctx context.Context, p *pool) (*member, net.Conn, error) {
+	var tried []*member
+	var lastErr error
+	for {
+		m := p.pick(tried...)
+		if m == nil {
+			if lastErr != nil {
+				return nil, nil, lastErr
+			}
+			return nil, nil, errors.New("no server available")
+		}
+		tried = append(tried, m)
+
+		start := time.Now()
+		rc, err := cl.dial(ctx, "tcp", m.Addr)
+		if err == nil {
+			p.connected(m, time.Since(start))
+			return m, rc, nil
+		}
+		p.release(m)
+		if ctx.Err() != nil {
+			return nil, nil, err
+		}
+		lastErr = err
+		d := p.down(m, err)
+		cl.logf("failed to connect to server %v: %v (retry in %v)", m.Addr, err, d)
+	}
+}
+
+// upstreamConn is the socket of a client UDP session, sending to the server the session
+// started with whatever the address passed to WriteTo.
+type upstreamConn struct {
+	net.PacketConn
+	server net.Addr
+	pool   *pool
+	m      *member
+	once   sync.Once
+}
+
+func (uc *upstreamConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := uc.PacketConn.ReadFrom(b)
+	if err == nil || isCipherError(err) {
+		uc.pool.result(uc.m, err)
+	}
+	return n, addr, err
+}
+
+func (uc *upstreamConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return uc.PacketConn.WriteTo(b, uc.server)
+}
+
+func (uc *upstreamConn) Close() error {
+	uc.once.Do(func() { uc.pool.release(uc.m) })
+	return uc.PacketConn.Close()
+}
+
+// dialPacket opens the socket of a new UDP session with a server picked by policy, trying the
+// next one if that fails.
+func (cl *Client) dialPacket() (*upstreamConn, error) {
+	p := cl.getPool()
+	var tried []*member
+	var lastErr error
+	for {
+		m := p.pick(tried...)
+		if m == nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, errors.New("no server available")
+		}
+		tried = append(tried, m)
+
+		srvAddr, err := net.ResolveUDPAddr("udp", m.udpAddr())
+		if err != nil {
+			p.release(m)
+			lastErr = err
+			d := p.down(m, err)
+			cl.logf("failed to resolve server %v: %v (retry in %v)", m.udpAddr(), err, d)
+			continue
+		}
+		pc, err := net.ListenPacket("udp", "")
+		if err != nil {
+			p.release(m)
+			lastErr = err
+			cl.logf("failed to open UDP socket for server %v: %v", m.udpAddr(), err)
+			continue
+		}
+		return &upstreamConn{PacketConn: m.Cipher.PacketConn(pc), server: srvAddr, pool: p, m: m}, nil
+	}
+}
+
+// ListenPacket opens a socket sending packets through a server whatever the rules, for use
+// by other services of the client such as its DNS forwarder. Addresses passed to WriteTo and
+// returned by ReadFrom are those of the targets.
+func (cl *Client) ListenPacket() (net.PacketConn, error) {
+	uc, err := cl.dialPacket()
+	if err != nil {
+		return nil, err
+	}
+	return tunnelConn{uc}, nil
+}
+
+// tunnelConn is a socket returned by ListenPacket.
+type tunnelConn struct {
+	*upstreamConn
+}
+
+func (tc tunnelConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	tgt := socks.ParseAddr(addr.String())
+	if tgt == nil {
+		return 0, errors.New("invalid target address")
+	}
+	if _, err := tc.upstreamConn.WriteTo(append(tgt, b...), nil); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (tc tunnelConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, _, err := tc.upstreamConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		src := socks.SplitAddr(buf[:n])
+		if src == nil {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", src.String())
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[len(src):n]), addr, nil
+	}
+}
+
+// directConn is the socket of a client UDP session sending directly to targets. Like the
+// packet conn of a server, it reads and writes payloads prefixed by the target address.
+type directConn struct {
+	net.PacketConn
+}
+
+func (dc directConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	tgt := socks.SplitAddr(b)
+	if tgt == nil {
+		return 0, errors.New("invalid target address")
+	}
+	addr, err := net.ResolveUDPAddr("udp", tgt.String())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := dc.PacketConn.WriteTo(b[len(tgt):], addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (dc directConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if len(b) < socks.MaxAddrLen {
+		return 0, nil, io.ErrShortBuffer
+	}
+	n, addr, err := dc.PacketConn.ReadFrom(b[socks.MaxAddrLen:])
+	if err != nil {
+		return 0, addr, err
+	}
+	src := socks.ParseAddr(addr.String())
+	copy(b, src)
+	copy(b[len(src):], b[socks.MaxAddrLen:socks.MaxAddrLen+n])
+	return len(src) + n, addr, nil
+}
+
+// ServePacketTunnel reads packets from pc and relays them to tgt through the server. It returns
+// when pc is closed, with ErrServerClosed after Shutdown, which closes pc once UDP sessions end.
+func (cl *Client) ServePacketTunnel(pc net.PacketConn, tgt socks.Addr) error {
+	return cl.servePacket(pc, relayClient, nil, func(b []byte, n int, _ net.Addr) ([]byte, error) {
+		copy(b[len(tgt):], b[:n])
+		copy(b, tgt)
+		return b[:len(tgt)+n], nil
+	})
+}
+
+// RedirPacketConn is a socket receiving packets redirected to it, e.g. by TPROXY on Linux,
+// which tells their original destination and can reply from any address.
+type RedirPacketConn interface {
+	net.PacketConn
+
+	// ReadFromOrig is like ReadFrom but also returns the original destination of the packet.
+	ReadFromOrig(b []byte) (n int, addr, orig net.Addr, err error)
+
+	// WriteToFrom is like WriteTo but sends from src, not necessarily a local address.
+	WriteToFrom(b []byte, addr, src net.Addr) (int, error)
+}
+
+// redirConn reads and writes packets of a RedirPacketConn prefixed by their original
+// destination and the source to reply from. Destinations are replaced by realTarget if
+// not nil.
+type redirConn struct {
+	RedirPacketConn
+	realTarget func(socks.Addr) socks.Addr
+}
+
+// fakeSource is the source of packets to a destination replaced by realTarget. It keeps
+// them in a session of their own, whose replies are sent from that destination.
+type fakeSource struct {
+	net.Addr
+	dst socks.Addr
+}
+
+func (a fakeSource) String() string { return a.Addr.String() + " via " + a.dst.String() }
+
+func (rc *redirConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if len(b) < socks.MaxAddrLen {
+		return 0, nil, io.ErrShortBuffer
+	}
+	n, addr, orig, err := rc.ReadFromOrig(b[socks.MaxAddrLen:])
+	if err != nil {
+		return 0, addr, err
+	}
+	tgt := socks.ParseAddr(orig.String())
+	if rc.realTarget != nil {
+		if real := rc.realTarget(tgt); real.String() != tgt.String() {
+			addr = fakeSource{addr, tgt}
+			tgt = real
+		}
+	}
+	copy(b, tgt)
+	copy(b[len(tgt):], b[socks.MaxAddrLen:socks.MaxAddrLen+n])
+	return len(tgt) + n, addr, nil
+}
+
+func (rc *redirConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	src := socks.SplitAddr(b)
+	if src == nil {
+		return 0, errors.New("invalid source address")
+	}
+	from := src
+	if a, ok := addr.(fakeSource); ok {
+		addr, from = a.Addr, a.dst
+	}
+	fromAddr, err := net.ResolveUDPAddr("udp", from.String())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := rc.WriteToFrom(b[len(src):], addr, fromAddr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ServePacketRedir reads packets redirected to pc and relays them to their original
+// destination through the server, replying from it. If realTarget is not nil, it replaces
+// the destinations, e.g. fake addresses by the names they stand for. It returns when pc is
+// closed, with ErrServerClosed after Shutdown, which closes pc once UDP sessions end.
+func (cl *Client) ServePacketRedir(pc RedirPacketConn, realTarget func(socks.Addr) socks.Addr) error {
+	return cl.servePacket(&redirConn{pc, realTarget}, redirClient, nil, func(b []byte, n int, _ net.Addr) ([]byte, error) {
+		return b[:n], nil
+	})
+}
+
+// ServePacket reads SOCKS5 UDP packets from pc and relays them through the server. Only
+// clients with a UDP association on a SOCKS connection to cl are served, until it closes.
+// Fragmented packets are reassembled. It returns when pc is closed, with ErrServerClosed
+// after Shutdown, which closes pc once UDP sessions end.
+func (cl *Client) ServePacket(pc net.PacketConn) error {
+	r := newReassembler()
+	return cl.servePacket(pc, socksClient, cl.association, func(b []byte, n int, src net.Addr) ([]byte, error) {
+		// RSV FRAG
+		if n < 3 {
+			return nil, errors.New("short SOCKS5 UDP packet")
+		}
+		return r.add(src.String(), b[2], b[3:n])
+	})
+}
+
+// servePacket relays packets read from pc through the server after converting them to
+// target address and payload with pkt, which returns nil for fragments to wait for the
+// rest. If assoc is not nil, packets are relayed only from sources it returns an
+// association for, and their sessions end with it.
+func (cl *Client) servePacket(pc net.PacketConn, role mode, assoc func(net.Addr) *association, pkt func(b []byte, n int, src net.Addr) ([]byte, error)) error {
+	if !cl.t.addPacket(pc) {
+		return ErrServerClosed
+	}
+	defer cl.t.removePacket(pc)
+
+	nm := newNATmap(cl.udpTimeout(), &cl.t)
+	buf := make([]byte, udpBufSize)
+	// leave room to prepend the target address
+	rbuf := buf[:udpBufSize-socks.MaxAddrLen]
+
+	for {
+		n, raddr, err := pc.ReadFrom(rbuf)
+		if err != nil {
+			if cl.t.isClosing() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			cl.logf("UDP local read error: %v", err)
+			continue
+		}
+		var a *association
+		if assoc != nil {
+			if a = assoc(raddr); a == nil {
+				cl.logf("UDP drop from %s: no association", raddr)
+				continue
+			}
+		}
+		b, err := pkt(buf, n, raddr)
+		if err != nil {
+			cl.logf("UDP local read error: %v", err)
+			continue
+		}
+		if b == nil {
+			continue
+		}
+
+		tgt := socks.SplitAddr(b)
+		if tgt == nil {
+			cl.logf("UDP local read error: invalid target address")
+			continue
+		}
+		// sessions going through a server and directly are kept apart
+		key := raddr.String()
+		src := raddr
+		if a, ok := raddr.(fakeSource); ok {
+			src = a.Addr
+		}
+		act := cl.route(src, "", tgt)
+		switch act {
+		case route.Reject:
+			cl.logf("UDP reject %s -> %s", raddr, tgt)
+			continue
+		case route.Direct:
+			key = "direct " + key
+		}
+
+		uc := nm.Get(key)
+		if uc == nil {
+			if cl.t.isClosing() {
+				continue
+			}
+			if act == route.Direct {
+				c, err := net.ListenPacket("udp", "")
+				if err != nil {
+					cl.logf("UDP local listen error: %v", err)
+					continue
+				}
+				uc = directConn{c}
+				cl.logf("UDP direct %s <-> %s", raddr, tgt)
+			} else {
+				c, err := cl.dialPacket()
+				if err != nil {
+					cl.logf("UDP local listen error: %v", err)
+					continue
+				}
+				uc = c
+				switch role {
+				case socksClient:
+					cl.logf("UDP socks tunnel %s <-> %s <-> %s", pc.LocalAddr(), c.server, tgt)
+				case redirClient:
+					cl.logf("UDP redirect %s <-> %s <-> %s", raddr, c.server, tgt)
+				}
+			}
+			if !nm.Add(key, raddr, pc, uc, role) {
+				uc.Close()
+				continue
+			}
+			if a != nil && !cl.join(a, nm, key) {
+				if c := nm.Del(key); c != nil {
+					c.Close()
+				}
+				continue
+			}
+		}
+
+		_, err = uc.WriteTo(b, nil)
+		if err != nil {
+			cl.logf("UDP local write error: %v", err)
+			continue
+		}
+	}
+}
+
+// Shutdown stops accepting connections and UDP sessions, then waits for active ones to
+// end. When ctx is done first, it closes them and returns an error with their number.
+func (cl *Client) Shutdown(ctx context.Context) error {
+	return cl.t.shutdown(ctx)
+}
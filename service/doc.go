@@ -0,0 +1,7 @@
+// Package service implements Shadowsocks clients and servers on top of package core.
+package service
+
+// Logger is implemented by *log.Logger.
+type Logger interface {
+	Output(calldepth int, s string) error
+}
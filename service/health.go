@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// maxProbeTimeout limits how long a health check waits for each server.
+const maxProbeTimeout = 10 * time.Second
+
+// ServerStatus is the state of a server of a Client.
+type ServerStatus struct {
+	Addr    string
+	Down    bool          // skipped by new connections and UDP sessions until retried
+	Latency time.Duration // smoothed connect latency, 0 if not measured yet
+	Active  int           // connections and UDP sessions
+	Checked time.Time     // last health check, zero if none
+	Err     error         // why last marked down, nil when up
+}
+
+// Status returns the state of the servers in order.
+func (cl *Client) Status() []ServerStatus {
+	p := cl.getPool()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	st := make([]ServerStatus, len(p.members))
+	for i, m := range p.members {
+		st[i] = ServerStatus{
+			Addr:    m.Addr,
+			Down:    now.Before(m.downUntil),
+			Latency: m.latency,
+			Active:  m.active,
+			Checked: m.checked,
+			Err:     m.err,
+		}
+	}
+	return st
+}
+
+// Check probes all servers in parallel by connecting through each to tgt, sending an HTTP
+// HEAD request and waiting for any response, e.g. from an HTTP or echo server. Servers that
+// respond are marked up with their connect latency, the others down. Check returns when
+// all probes end or ctx is done.
+func (cl *Client) Check(ctx context.Context, tgt socks.Addr) {
+	p := cl.getPool()
+	var wg sync.WaitGroup
+	for _, m := range p.members {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			latency, err := cl.probe(ctx, m, tgt)
+			if err != nil && ctx.Err() == context.Canceled {
+				return
+			}
+			if p.check(m, latency, err) {
+				if err != nil {
+					cl.logf("server %s is down: %v", m.Addr, err)
+				} else {
+					cl.logf("server %s is up (latency %v)", m.Addr, latency)
+				}
+			}
+		}(m)
+	}
+	wg.Wait()
+}
+
+// HealthCheck runs Check every interval until ctx is done, giving each the interval or at
+// most 10 seconds.
+func (cl *Client) HealthCheck(ctx context.Context, tgt socks.Addr, interval time.Duration) {
+	timeout := interval
+	if timeout > maxProbeTimeout {
+		timeout = maxProbeTimeout
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		cctx, cancel := context.WithTimeout(ctx, timeout)
+		cl.Check(cctx, tgt)
+		cancel()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probe returns the latency of connecting to m, or why m failed to relay to tgt.
+func (cl *Client) probe(ctx context.Context, m *member, tgt socks.Addr) (time.Duration, error) {
+	start := time.Now()
+	rc, err := cl.dial(ctx, "tcp", m.Addr)
+	if err != nil {
+		return 0, err
+	}
+	latency := time.Since(start)
+	defer rc.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			rc.Close()
+		case <-stop:
+		}
+	}()
+
+	sc := m.Cipher.StreamConn(rc)
+	req := append(append([]byte{}, tgt...), "HEAD / HTTP/1.1\r\nHost: "+tgt.String()+"\r\nConnection: close\r\n\r\n"...)
+	if _, err := sc.Write(req); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(sc, make([]byte, 1)); err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if err == io.EOF {
+			return 0, errors.New("closed without response")
+		}
+		return 0, err
+	}
+	return latency, nil
+}
@@ -0,0 +1,261 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// hopHeaders are removed when forwarding, as they only apply to one connection.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ServeHTTPProxy accepts HTTP proxy connections on l and proxies them through the server:
+// CONNECT tunnels and plain HTTP requests to absolute URIs. It returns when l is closed,
+// with ErrServerClosed after Shutdown.
+func (cl *Client) ServeHTTPProxy(l net.Listener) error {
+	return cl.t.serve(l, cl.logf, func(ctx context.Context, c net.Conn) {
+		cl.serveHTTP(ctx, c, bufio.NewReader(c))
+	})
+}
+
+// bufConn reads what is buffered in r before the rest of a connection.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// httpUpstream is the connection to the target of the last forwarded request, kept for the
+// next requests to the same target.
+type httpUpstream struct {
+	tgt    string
+	user   string
+	rc     net.Conn
+	br     *bufio.Reader
+	finish func(error)
+}
+
+func (up *httpUpstream) roundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Write(up.rc); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(up.br, req)
+}
+
+// serveHTTP handles HTTP proxy requests read from br on c until c or the target closes.
+func (cl *Client) serveHTTP(ctx context.Context, c net.Conn, br *bufio.Reader) {
+	var up *httpUpstream
+	defer func() {
+		if up != nil {
+			up.finish(nil)
+		}
+	}()
+
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				cl.logf("failed to read HTTP request: %v", err)
+			}
+			return
+		}
+
+		user, ok := cl.proxyUser(req)
+		if !ok {
+			cl.logf("HTTP proxy authentication failed from %s", c.RemoteAddr())
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+				"Proxy-Authenticate: Basic realm=\"shadowsocks\"\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+
+		if req.Method == http.MethodConnect {
+			tgt := socks.ParseAddr(hostPort(req.Host, "443"))
+			if tgt == nil {
+				httpError(c, http.StatusBadRequest)
+				return
+			}
+			rc, finish, err := cl.dialTarget(ctx, c.RemoteAddr(), user, tgt)
+			if err != nil {
+				httpError(c, dialStatus(err))
+				return
+			}
+			if _, err := io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+				finish(err)
+				return
+			}
+			err = relay(ctx, rc, &bufConn{c, br})
+			if err != nil {
+				cl.logf("relay error: %v", err)
+			}
+			finish(err)
+			return
+		}
+
+		if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+			httpError(c, http.StatusBadRequest)
+			return
+		}
+		tgt := socks.ParseAddr(hostPort(req.URL.Host, "80"))
+		if tgt == nil {
+			httpError(c, http.StatusBadRequest)
+			return
+		}
+		if up != nil && (up.tgt != tgt.String() || up.user != user) {
+			up.finish(nil)
+			up = nil
+		}
+		reused := up != nil
+
+		upgrade := upgradeType(req.Header)
+		removeHopHeaders(req.Header)
+		if upgrade != "" {
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", upgrade)
+		}
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header.Set("User-Agent", "") // not the default of Request.Write
+		}
+
+		var resp *http.Response
+		for {
+			if up == nil {
+				rc, finish, err := cl.dialTarget(ctx, c.RemoteAddr(), user, tgt)
+				if err != nil {
+					httpError(c, dialStatus(err))
+					return
+				}
+				up = &httpUpstream{tgt: tgt.String(), user: user, rc: rc, br: bufio.NewReader(rc), finish: finish}
+			}
+			resp, err = up.roundTrip(req)
+			if err == nil {
+				break
+			}
+			up.finish(err)
+			up = nil
+			// the target may have closed a kept connection in the meantime
+			if reused && req.Body == http.NoBody {
+				reused = false
+				continue
+			}
+			cl.logf("failed to forward HTTP request: %v", err)
+			httpError(c, http.StatusBadGateway)
+			return
+		}
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			err := resp.Write(c)
+			if err == nil {
+				err = relay(ctx, &bufConn{up.rc, up.br}, &bufConn{c, br})
+			}
+			if err != nil {
+				cl.logf("relay error: %v", err)
+			}
+			up.finish(err)
+			up = nil
+			return
+		}
+
+		keepAlive := !req.Close && !resp.Close && !cl.t.isClosing()
+		removeHopHeaders(resp.Header)
+		resp.Close = !keepAlive
+		err = resp.Write(c)
+		resp.Body.Close()
+		if err != nil {
+			cl.logf("failed to write HTTP response: %v", err)
+			return
+		}
+		if !keepAlive {
+			return
+		}
+	}
+}
+
+// proxyUser returns the user authenticated by the Proxy-Authorization header of req, or
+// false if authentication is required and fails.
+func (cl *Client) proxyUser(req *http.Request) (string, bool) {
+	auth := cl.auth()
+	if auth == nil {
+		return "", true
+	}
+	const prefix = "Basic "
+	h := req.Header.Get("Proxy-Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(h[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+	i := bytes.IndexByte(b, ':')
+	if i < 0 {
+		return "", false
+	}
+	user := string(b[:i])
+	return user, auth(user, string(b[i+1:]))
+}
+
+// hostPort returns host with port if it has none.
+func hostPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// upgradeType returns the protocol requested by the Upgrade header, if in Connection.
+func upgradeType(h http.Header) string {
+	for _, v := range h["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// removeHopHeaders removes hop-by-hop headers, including those listed in Connection.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// dialStatus returns the HTTP status replying to a failure of dialTarget.
+func dialStatus(err error) int {
+	if err == errRejected {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+func httpError(c net.Conn, code int) {
+	fmt.Fprintf(c, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+type mode int
+
+const (
+	remoteServer mode = iota
+	relayClient
+	socksClient
+	redirClient
+)
+
+const udpBufSize = 64 * 1024
+
+// Packet NAT table
+type natmap struct {
+	sync.RWMutex
+	m       map[string]net.PacketConn
+	timeout time.Duration
+	t       *tracker
+}
+
+func newNATmap(timeout time.Duration, t *tracker) *natmap {
+	m := &natmap{}
+	m.m = make(map[string]net.PacketConn)
+	m.timeout = timeout
+	m.t = t
+	return m
+}
+
+func (m *natmap) Get(key string) net.PacketConn {
+	m.RLock()
+	defer m.RUnlock()
+	return m.m[key]
+}
+
+func (m *natmap) Set(key string, pc net.PacketConn) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.m[key] = pc
+}
+
+func (m *natmap) Del(key string) net.PacketConn {
+	m.Lock()
+	defer m.Unlock()
+
+	pc, ok := m.m[key]
+	if ok {
+		delete(m.m, key)
+		return pc
+	}
+	return nil
+}
+
+// Add relays packets from src back to peer through dst until src times out, keeping src
+// under key. Returns false without adding src if shutting down.
+func (m *natmap) Add(key string, peer net.Addr, dst, src net.PacketConn, role mode) bool {
+	if m.t.add(src) == nil {
+		return false
+	}
+	m.Set(key, src)
+
+	go func() {
+		defer m.t.done(src)
+		timedCopy(dst, peer, src, m.timeout, role)
+		if pc := m.Del(key); pc != nil {
+			pc.Close()
+		}
+	}()
+	return true
+}
+
+// copy from src to dst at target with read timeout
+func timedCopy(dst net.PacketConn, target net.Addr, src net.PacketConn, timeout time.Duration, role mode) error {
+	buf := make([]byte, udpBufSize)
+
+	for {
+		src.SetReadDeadline(time.Now().Add(timeout))
+		n, raddr, err := src.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		switch role {
+		case remoteServer: // server -> client: add original packet source
+			srcAddr := socks.ParseAddr(raddr.String())
+			copy(buf[len(srcAddr):], buf[:n])
+			copy(buf, srcAddr)
+			_, err = dst.WriteTo(buf[:len(srcAddr)+n], target)
+		case relayClient: // client -> user: strip original packet source
+			srcAddr := socks.SplitAddr(buf[:n])
+			_, err = dst.WriteTo(buf[len(srcAddr):n], target)
+		case socksClient: // client -> socks5 program: just set RSV and FRAG = 0
+			_, err = dst.WriteTo(append([]byte{0, 0, 0}, buf[:n]...), target)
+		case redirClient: // client -> redirected program: keep original packet source to reply from
+			_, err = dst.WriteTo(buf[:n], target)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
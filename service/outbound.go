@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// errDenied is returned for targets denied by the ACL.
+var errDenied = errors.New("denied by ACL")
+
+// udpResolveTimeout bounds resolving the target of a packet, which holds up the others.
+const udpResolveTimeout = 5 * time.Second
+
+// dialTarget connects to tgt for a client at src, by user if any, as allowed by the ACL. Names
+// are resolved before connecting and only the allowed addresses are connected to, so that
+// the name can't resolve to another one on connect.
+func (s *Server) dialTarget(ctx context.Context, src net.Addr, user string, tgt socks.Addr) (net.Conn, error) {
+	acl := s.getACL()
+	if allow, decided := acl.Allow(src, user, tgt, nil); decided && !allow {
+		s.logf("deny %s -> %s", src, tgt)
+		return nil, errDenied
+	}
+	host, port, err := net.SplitHostPort(tgt.String())
+	if err != nil {
+		return nil, err
+	}
+	ips, err := lookupIP(ctx, s.getResolver(), host)
+	if err != nil {
+		return nil, err
+	}
+	err = errDenied
+	for _, ip := range ips {
+		if allow, _ := acl.Allow(src, user, tgt, ip); !allow {
+			s.logf("deny %s -> %s (%s)", src, tgt, ip)
+			continue
+		}
+		var rc net.Conn
+		if rc, err = s.dial(ctx, "tcp", net.JoinHostPort(ip.String(), port)); err == nil {
+			return rc, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// resolveUDP returns the first address of tgt allowed by the ACL for packets from src.
+func (s *Server) resolveUDP(src net.Addr, tgt socks.Addr) (*net.UDPAddr, error) {
+	acl := s.getACL()
+	host, port, err := net.SplitHostPort(tgt.String())
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), udpResolveTimeout)
+	defer cancel()
+	ips, err := lookupIP(ctx, s.getResolver(), host)
+	if err != nil {
+		return nil, err
+	}
+	user := ""
+	if ua, ok := src.(core.UserAddr); ok {
+		user = ua.User()
+	}
+	for _, ip := range ips {
+		if allow, _ := acl.Allow(src, user, tgt, ip); !allow {
+			s.logf("deny UDP %s -> %s (%s)", src, tgt, ip)
+			continue
+		}
+		return &net.UDPAddr{IP: ip, Port: p}, nil
+	}
+	return nil, errDenied
+}
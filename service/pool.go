@@ -0,0 +1,230 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead2022"
+)
+
+// Policy selects the server of new connections and UDP sessions among those not marked down.
+type Policy int
+
+const (
+	Failover         Policy = iota // the first server in order
+	RoundRobin                     // each server in turn
+	LeastConnections               // the server with the fewest active connections and sessions
+	LowestLatency                  // the server with the lowest connect latency
+)
+
+var policyNames = []string{"failover", "roundrobin", "leastconn", "latency"}
+
+func (p Policy) String() string {
+	if int(p) < len(policyNames) {
+		return policyNames[p]
+	}
+	return "unknown"
+}
+
+// ParsePolicy returns the policy named failover, roundrobin, leastconn or latency.
+func ParsePolicy(name string) (Policy, error) {
+	for i, s := range policyNames {
+		if strings.EqualFold(name, s) {
+			return Policy(i), nil
+		}
+	}
+	return 0, errors.New("unknown policy " + name + ": want " + strings.Join(policyNames, ", "))
+}
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+
+	// cipherErrLimit is the number of consecutive decryption errors marking a server down.
+	cipherErrLimit = 3
+)
+
+// member is a server of a pool and its state.
+type member struct {
+	Upstream
+	active     int
+	latency    time.Duration // smoothed connect latency, 0 if not measured yet
+	failures   int           // consecutive times marked down
+	cipherErrs int           // consecutive decryption errors
+	downUntil  time.Time
+	err        error     // why last marked down
+	checked    time.Time // last health check
+}
+
+// pool picks servers for a Client.
+type pool struct {
+	mu      sync.Mutex
+	members []*member
+	policy  Policy
+	next    int // round robin
+}
+
+func newPool(policy Policy, ups []Upstream) *pool {
+	p := &pool{policy: policy}
+	for _, up := range ups {
+		p.members = append(p.members, &member{Upstream: up})
+	}
+	return p
+}
+
+// pick returns a server by policy and counts a connection or session on it until release.
+// If all servers are down, it returns the one to be retried soonest. Servers in skip are
+// not returned; pick returns nil if there are no others.
+func (p *pool) pick(skip ...*member) *member {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var candidates []*member
+	for _, m := range p.members {
+		if now.Before(m.downUntil) || contains(skip, m) {
+			continue
+		}
+		candidates = append(candidates, m)
+	}
+
+	var best *member
+	switch {
+	case len(candidates) == 0: // retry the server down for the shortest time
+		for _, m := range p.members {
+			if contains(skip, m) {
+				continue
+			}
+			if best == nil || m.downUntil.Before(best.downUntil) {
+				best = m
+			}
+		}
+		if best == nil {
+			return nil
+		}
+	case p.policy == RoundRobin:
+		for i := range p.members {
+			j := (p.next + i) % len(p.members)
+			if contains(candidates, p.members[j]) {
+				best = p.members[j]
+				p.next = j + 1
+				break
+			}
+		}
+	case p.policy == LeastConnections:
+		for _, m := range candidates {
+			if best == nil || m.active < best.active {
+				best = m
+			}
+		}
+	case p.policy == LowestLatency:
+		for _, m := range candidates {
+			if best == nil || m.latency < best.latency { // unmeasured servers first
+				best = m
+			}
+		}
+	default:
+		best = candidates[0]
+	}
+	best.active++
+	return best
+}
+
+func contains(ms []*member, m *member) bool {
+	for _, v := range ms {
+		if v == m {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *pool) release(m *member) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m.active--
+}
+
+// down marks m down by err with exponential backoff.
+func (p *pool) down(m *member, err error) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m.err = err
+	m.failures++
+	m.cipherErrs = 0
+	d := minBackoff << uint(m.failures-1)
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	m.downUntil = time.Now().Add(d)
+	return d
+}
+
+// connected records a successful connection to m taking latency.
+func (p *pool) connected(m *member, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m.failures = 0
+	m.downUntil = time.Time{}
+	m.err = nil
+	if m.latency == 0 {
+		m.latency = latency
+	} else {
+		m.latency = (m.latency*7 + latency) / 8
+	}
+}
+
+// check records a health check of m, which failed if err is not nil. Reports whether m
+// changed between up and down.
+func (p *pool) check(m *member, latency time.Duration, err error) bool {
+	p.mu.Lock()
+	m.checked = time.Now()
+	wasDown := m.checked.Before(m.downUntil)
+	p.mu.Unlock()
+	if err != nil {
+		p.down(m, err)
+		return !wasDown
+	}
+	p.connected(m, latency)
+	return wasDown
+}
+
+// result records whether a connection through m was decrypted fine. Reports whether m is
+// marked down by repeated decryption errors.
+func (p *pool) result(m *member, err error) bool {
+	p.mu.Lock()
+	if !isCipherError(err) {
+		m.cipherErrs = 0
+		p.mu.Unlock()
+		return false
+	}
+	m.cipherErrs++
+	n := m.cipherErrs
+	p.mu.Unlock()
+	if n < cipherErrLimit {
+		return false
+	}
+	p.down(m, err)
+	return true
+}
+
+// isCipherError reports whether err is a failure to decrypt, as with a server using another
+// key, rather than of the network or of the local side.
+func isCipherError(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, e := range []error{
+		shadowaead.ErrRepeatedSalt, shadowaead.ErrShortPacket, shadowaead2022.ErrRepeatedSalt,
+		shadowaead2022.ErrBadTimestamp, shadowaead2022.ErrBadHeader, shadowaead2022.ErrShortPacket,
+	} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	// failed cipher.AEAD Open, whose error is not exported
+	return strings.HasSuffix(err.Error(), "message authentication failed")
+}
@@ -0,0 +1,260 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/route"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Server relays connections and packets of Shadowsocks clients to their targets.
+type Server struct {
+	// DialContext connects to targets. Uses net.Dialer if nil.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// UDPTimeout is how long idle UDP sessions are kept. Defaults to 5 minutes.
+	UDPTimeout time.Duration
+
+	// TCPCork coalesces writing the first few packets of each connection.
+	TCPCork bool
+
+	// Bind lets clients listen for a connection on the server, for SOCKS5 BIND requests.
+	Bind bool
+
+	// BindAddr is the IP address BIND listens on, e.g. the public address of a server behind
+	// a plugin. If empty, it is the address the client reached the server at, and BIND is
+	// refused if that is loopback.
+	BindAddr string
+
+	// Logger logs verbose messages if not nil.
+	Logger Logger
+
+	mu     sync.RWMutex
+	cipher core.Cipher
+	acl    *route.ACL
+	res    Resolver
+	t      tracker
+}
+
+// Resolver looks up the addresses of target names, in the order to try them.
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// NewServer returns a Server decrypting with ciph.
+func NewServer(ciph core.Cipher) *Server {
+	return &Server{cipher: ciph}
+}
+
+// Cipher returns the cipher of new connections and packets.
+func (s *Server) Cipher() core.Cipher {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cipher
+}
+
+// SetCipher changes the cipher of new connections and packets. Established connections
+// and UDP sessions keep the cipher they started with.
+func (s *Server) SetCipher(ciph core.Cipher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cipher = ciph
+}
+
+// SetACL changes the rules deciding which targets new connections and packets may reach. If
+// acl is nil, all are allowed but the loopback, link-local, private and other special addresses
+// denied by default.
+func (s *Server) SetACL(acl *route.ACL) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acl = acl
+}
+
+func (s *Server) getACL() *route.ACL {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.acl
+}
+
+// SetResolver changes how the targets of new connections and packets are resolved. They are
+// resolved by the system if r is nil.
+func (s *Server) SetResolver(r Resolver) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.res = r
+}
+
+func (s *Server) getResolver() Resolver {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.res
+}
+
+// lookupIP returns the addresses of host with r, or the system resolver if nil.
+func lookupIP(ctx context.Context, r Resolver, host string) ([]net.IP, error) {
+	if r != nil {
+		return r.LookupIP(ctx, host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+func (s *Server) logf(f string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Output(2, fmt.Sprintf(f, v...))
+	}
+}
+
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if s.DialContext != nil {
+		return s.DialContext(ctx, network, addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+func (s *Server) udpTimeout() time.Duration {
+	if s.UDPTimeout > 0 {
+		return s.UDPTimeout
+	}
+	return 5 * time.Minute
+}
+
+// Serve accepts connections on l and relays them to their targets. It returns when l is
+// closed, with ErrServerClosed after Shutdown.
+func (s *Server) Serve(l net.Listener) error {
+	return s.t.serve(l, s.logf, s.handle)
+}
+
+func (s *Server) handle(ctx context.Context, c net.Conn) {
+	if s.TCPCork {
+		c = timedCork(c, 10*time.Millisecond, 1280)
+	}
+	sc := s.Cipher().StreamConn(c)
+
+	tgt, err := socks.ReadAddr(sc)
+	if err != nil {
+		s.logf("failed to get target address from %v: %v", c.RemoteAddr(), err)
+		// drain c to avoid leaking server behavioral features
+		// see https://www.ndss-symposium.org/ndss-paper/detecting-probe-resistant-proxies/
+		_, err = io.Copy(ioutil.Discard, c)
+		if err != nil {
+			s.logf("discard error: %v", err)
+		}
+		return
+	}
+
+	if s.Bind && isBind(tgt) {
+		s.bind(ctx, c, sc)
+		return
+	}
+
+	rc, err := s.dialTarget(ctx, c.RemoteAddr(), userOf(sc), tgt)
+	if err != nil {
+		s.logf("failed to connect to target: %v", err)
+		return
+	}
+	defer rc.Close()
+
+	s.logf("proxy %s <-> %s", peerName(sc), tgt)
+	if err = relay(ctx, sc, rc); err != nil {
+		s.logf("relay error: %v", err)
+	}
+}
+
+// ServePacket reads encrypted packets from pc and basically does UDP NAT. It returns when
+// pc is closed, with ErrServerClosed after Shutdown, which closes pc once UDP sessions end.
+func (s *Server) ServePacket(pc net.PacketConn) error {
+	if !s.t.addPacket(pc) {
+		return ErrServerClosed
+	}
+	defer s.t.removePacket(pc)
+
+	var c net.PacketConn
+	var cur core.Cipher
+	nm := newNATmap(s.udpTimeout(), &s.t)
+	buf := make([]byte, udpBufSize)
+
+	for {
+		// sessions already in the NAT table keep replying with the cipher they started with
+		if ciph := s.Cipher(); ciph != cur {
+			c, cur = ciph.PacketConn(pc), ciph
+		}
+
+		n, raddr, err := c.ReadFrom(buf)
+		if err != nil {
+			if s.t.isClosing() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			s.logf("UDP remote read error: %v", err)
+			continue
+		}
+
+		tgtAddr := socks.SplitAddr(buf[:n])
+		if tgtAddr == nil {
+			s.logf("failed to split target address from packet: %q", buf[:n])
+			continue
+		}
+
+		tgtUDPAddr, err := s.resolveUDP(raddr, tgtAddr)
+		if err != nil {
+			s.logf("failed to resolve target UDP address: %v", err)
+			continue
+		}
+
+		payload := buf[len(tgtAddr):n]
+
+		rc := nm.Get(raddr.String())
+		if rc == nil {
+			if s.t.isClosing() {
+				continue
+			}
+			rc, err = net.ListenPacket("udp", "")
+			if err != nil {
+				s.logf("UDP remote listen error: %v", err)
+				continue
+			}
+			if ua, ok := raddr.(core.UserAddr); ok {
+				s.logf("UDP NAT %s@%s <-> %s", ua.User(), raddr, tgtAddr)
+			}
+
+			if !nm.Add(raddr.String(), raddr, c, rc, remoteServer) {
+				rc.Close()
+				continue
+			}
+		}
+
+		_, err = rc.WriteTo(payload, tgtUDPAddr) // accept only UDPAddr despite the signature
+		if err != nil {
+			s.logf("UDP remote write error: %v", err)
+			continue
+		}
+	}
+}
+
+// Shutdown stops accepting connections and UDP sessions, then waits for active ones to
+// end. When ctx is done first, it closes them and returns an error with their number.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.t.shutdown(ctx)
+}
@@ -0,0 +1,771 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/route"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead2022"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func TestMain(m *testing.M) {
+	// clients and servers share the salt filter in one process
+	os.Setenv("SHADOWSOCKS_SF_CAPACITY", "0")
+	os.Exit(m.Run())
+}
+
+// pair starts a server and a client relaying through it.
+func pair(t *testing.T) (*Client, *Server) {
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(ciph)
+	acl, err := route.ParseACL(strings.NewReader("IP-CIDR,127.0.0.0/8,allow"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetACL(acl)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	go srv.ServePacket(pc)
+	cl := NewClient(Failover, Upstream{Addr: l.Addr().String(), UDPAddr: pc.LocalAddr().String(), Cipher: ciph})
+	return cl, srv
+}
+
+func echo(t *testing.T) (net.Listener, net.PacketConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, udpBufSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return l, pc
+}
+
+func TestTunnel(t *testing.T) {
+	el, epc := echo(t)
+	defer el.Close()
+	defer epc.Close()
+	cl, srv := pair(t)
+	closed, cancel := context.WithCancel(context.Background())
+	cancel()
+	defer srv.Shutdown(closed)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cl.ServeTunnel(l, socks.ParseAddr(el.Addr().String()))
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cl.ServePacketTunnel(pc, socks.ParseAddr(epc.LocalAddr().String()))
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("TCP echo: got %q, %v", buf, err)
+	}
+
+	uc, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	uc.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := uc.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := uc.Read(buf)
+	if err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("UDP echo: got %q, %v", buf[:n], err)
+	}
+
+	// an active connection is closed when the grace period ends
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := cl.Shutdown(ctx); err == nil {
+		t.Fatal("Shutdown with active sessions returned nil")
+	}
+	if _, err := io.ReadFull(c, buf); err == nil {
+		t.Fatal("connection still open after Shutdown")
+	}
+	if err := cl.ServeTunnel(l, nil); err != ErrServerClosed {
+		t.Fatalf("Serve after Shutdown: got %v, want ErrServerClosed", err)
+	}
+}
+
+func TestShutdownIdle(t *testing.T) {
+	_, srv := pair(t)
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPool(t *testing.T) {
+	ups := []Upstream{{Addr: "a"}, {Addr: "b"}, {Addr: "c"}}
+	picks := func(p *pool, n int) string {
+		var s string
+		for i := 0; i < n; i++ {
+			s += p.pick().Addr
+		}
+		return s
+	}
+
+	p := newPool(RoundRobin, ups)
+	if got := picks(p, 4); got != "abca" {
+		t.Errorf("round robin: got %s, want abca", got)
+	}
+	p.down(p.members[1], nil)
+	if got := picks(p, 3); got != "cac" {
+		t.Errorf("round robin with b down: got %s, want cac", got)
+	}
+
+	p = newPool(Failover, ups)
+	p.down(p.members[0], nil)
+	if got := picks(p, 2); got != "bb" {
+		t.Errorf("failover with a down: got %s, want bb", got)
+	}
+	p.down(p.members[1], nil)
+	p.down(p.members[1], nil) // longer backoff
+	p.down(p.members[2], nil)
+	if got := p.pick().Addr; got != "a" {
+		t.Errorf("all down: got %s, want a retried first", got)
+	}
+
+	p = newPool(LeastConnections, ups)
+	if got := picks(p, 4); got != "abca" {
+		t.Errorf("least connections: got %s, want abca", got)
+	}
+	p.release(p.members[1])
+	if got := p.pick().Addr; got != "b" {
+		t.Errorf("least connections after release: got %s, want b", got)
+	}
+
+	p = newPool(LowestLatency, ups)
+	p.connected(p.members[0], 30*time.Millisecond)
+	p.connected(p.members[1], 10*time.Millisecond)
+	p.connected(p.members[2], 20*time.Millisecond)
+	if got := p.pick().Addr; got != "b" {
+		t.Errorf("lowest latency: got %s, want b", got)
+	}
+	for i := 0; i < cipherErrLimit; i++ {
+		p.result(p.members[1], errors.New("cipher: message authentication failed"))
+	}
+	if got := p.pick().Addr; got != "c" {
+		t.Errorf("lowest latency after decryption errors on b: got %s, want c", got)
+	}
+	for err, want := range map[error]bool{
+		io.EOF:                               false,
+		errors.New("invalid target address"): false,
+		&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}: false,
+		fmt.Errorf("relay: %w", shadowaead2022.ErrRepeatedSalt):               true,
+		shadowaead.ErrShortPacket:                                             true,
+		errors.New("chacha20poly1305: message authentication failed"):         true,
+	} {
+		if got := isCipherError(err); got != want {
+			t.Errorf("isCipherError(%v) = %v, want %v", err, got, want)
+		}
+	}
+
+	// UDP sessions fail over like connections
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := NewClient(Failover, Upstream{Addr: "a", UDPAddr: "127.0.0.1", Cipher: ciph}, Upstream{Addr: "b", UDPAddr: "127.0.0.1:8488", Cipher: ciph})
+	uc, err := cl.dialPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc.Close()
+	if uc.m.Addr != "b" {
+		t.Errorf("UDP with a unresolvable: got %s, want b", uc.m.Addr)
+	}
+	if p := cl.getPool(); !time.Now().Before(p.members[0].downUntil) {
+		t.Error("unresolvable a not marked down")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	el, epc := echo(t)
+	defer el.Close()
+	defer epc.Close()
+	cl, _ := pair(t)
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	up := cl.getPool().members[0].Upstream
+	cl.SetUpstreams(Failover, Upstream{Addr: dead.Addr().String(), Cipher: up.Cipher}, up)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cl.Check(ctx, socks.ParseAddr(el.Addr().String()))
+	st := cl.Status()
+	if !st[0].Down || st[0].Err == nil || st[0].Checked.IsZero() {
+		t.Errorf("dead server: got %+v, want down", st[0])
+	}
+	if st[1].Down || st[1].Latency == 0 {
+		t.Errorf("live server: got %+v, want up with latency", st[1])
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	cl, srv := pair(t)
+	closed, cancel := context.WithCancel(context.Background())
+	cancel()
+	defer srv.Shutdown(closed)
+	defer cl.Shutdown(closed)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cl.ServeHTTPProxy(l)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Method+" "+r.URL.Path)
+	})
+	hs := httptest.NewServer(handler)
+	defer hs.Close()
+	tls := httptest.NewTLSServer(handler)
+	defer tls.Close()
+
+	proxy, _ := url.Parse("http://" + l.Addr().String())
+	tr := tls.Client().Transport.(*http.Transport)
+	tr.Proxy = http.ProxyURL(proxy)
+	hc := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+	for _, u := range []string{hs.URL + "/a", hs.URL + "/b", tls.URL + "/c"} { // keep-alive, then CONNECT
+		resp, err := hc.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want := "GET " + u[strings.LastIndex(u, "/"):]; err != nil || string(b) != want {
+			t.Errorf("%s: got %q, %v, want %q", u, b, err, want)
+		}
+	}
+}
+
+func TestMixed(t *testing.T) {
+	el, epc := echo(t)
+	defer el.Close()
+	defer epc.Close()
+	cl, srv := pair(t)
+	closed, cancel := context.WithCancel(context.Background())
+	cancel()
+	defer srv.Shutdown(closed)
+	defer cl.Shutdown(closed)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cl.ServeMixed(l)
+
+	tgt := el.Addr().String()
+	for _, tt := range []struct {
+		name      string
+		handshake func(c net.Conn, br *bufio.Reader) error
+	}{
+		{"SOCKS5", func(c net.Conn, br *bufio.Reader) error {
+			if _, err := c.Write(append([]byte{5, 1, 0, 5, socks.CmdConnect, 0}, socks.ParseAddr(tgt)...)); err != nil {
+				return err
+			}
+			b := make([]byte, 2+10)
+			if _, err := io.ReadFull(br, b); err != nil {
+				return err
+			}
+			if b[3] != 0 {
+				return fmt.Errorf("reply %d", b[3])
+			}
+			return nil
+		}},
+		{"SOCKS4a", func(c net.Conn, br *bufio.Reader) error {
+			_, port, _ := net.SplitHostPort(tgt)
+			p, _ := strconv.Atoi(port)
+			req := []byte{4, socks.CmdConnect, byte(p >> 8), byte(p), 0, 0, 0, 1}
+			if _, err := c.Write(append(append(req, "user\x00"...), "localhost\x00"...)); err != nil {
+				return err
+			}
+			b := make([]byte, 8)
+			if _, err := io.ReadFull(br, b); err != nil {
+				return err
+			}
+			if b[1] != 0x5a {
+				return fmt.Errorf("reply %#x", b[1])
+			}
+			return nil
+		}},
+		{"HTTP CONNECT", func(c net.Conn, br *bufio.Reader) error {
+			if _, err := io.WriteString(c, "CONNECT "+tgt+" HTTP/1.1\r\nHost: "+tgt+"\r\n\r\n"); err != nil {
+				return err
+			}
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("status %s", resp.Status)
+			}
+			return nil
+		}},
+	} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(c)
+		if err := tt.handshake(c, br); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			c.Close()
+			continue
+		}
+		buf := make([]byte, 5)
+		if _, err := c.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("%s: echo got %q, %v", tt.name, buf, err)
+		}
+		c.Close()
+	}
+}
+
+func TestDeferReply(t *testing.T) {
+	el, epc := echo(t)
+	defer el.Close()
+	defer epc.Close()
+	cl, srv := pair(t)
+	closed, cancel := context.WithCancel(context.Background())
+	cancel()
+	defer srv.Shutdown(closed)
+	defer cl.Shutdown(closed)
+	cl.DeferReply = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cl.Serve(l)
+
+	connect := func() []byte {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write(append([]byte{5, 1, 0, 5, socks.CmdConnect, 0}, socks.ParseAddr(el.Addr().String())...))
+		reply := make([]byte, 2+10)
+		if _, err := io.ReadFull(c, reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply[2:]
+	}
+	if reply := connect(); reply[1] != 0 || socks.Addr(reply[3:]).String() == "0.0.0.0:0" {
+		t.Errorf("connected: got %v, want success with the bound address", reply)
+	}
+
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	cl.SetUpstreams(Failover, Upstream{Addr: dead.Addr().String(), Cipher: cl.getPool().members[0].Cipher})
+	if reply := connect(); reply[1] != byte(socks.ErrConnectionRefused) {
+		t.Errorf("server refused: got %v, want connection refused", reply)
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	el, epc := echo(t)
+	defer el.Close()
+	defer epc.Close()
+	cl, srv := pair(t)
+	closed, cancel := context.WithCancel(context.Background())
+	cancel()
+	defer srv.Shutdown(closed)
+	defer cl.Shutdown(closed)
+	socks.UDPEnabled = true
+	defer func() { socks.UDPEnabled = false }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cl.Serve(l)
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cl.ServePacket(pc)
+
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write(append([]byte{5, 1, 0, 5, socks.CmdUDPAssociate, 0}, socks.ParseAddr(uc.LocalAddr().String())...))
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(c, reply); err != nil || reply[3] != 0 {
+		t.Fatalf("associate: got %v, %v", reply, err)
+	}
+
+	tgt := socks.ParseAddr(epc.LocalAddr().String())
+	send := func(from *net.UDPConn, frag byte, data string) {
+		from.WriteTo(append(append([]byte{0, 0, frag}, tgt...), data...), pc.LocalAddr())
+	}
+	recv := func(from *net.UDPConn) string {
+		from.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, udpBufSize)
+		n, _, err := from.ReadFrom(buf)
+		if err != nil {
+			return ""
+		}
+		return string(buf[3+len(tgt) : n])
+	}
+
+	send(uc, 1, "hel")
+	send(uc, 0x82, "lo")
+	if got := recv(uc); got != "hello" {
+		t.Errorf("fragments: got %q, want hello", got)
+	}
+	send(uc, 1, "a")
+	send(uc, 3, "b") // lost fragment 2
+	send(uc, 0x84, "c")
+	send(uc, 0, "whole")
+	if got := recv(uc); got != "whole" {
+		t.Errorf("after incomplete fragments: got %q, want whole", got)
+	}
+	send(uc, 1, "a")
+	send(uc, 0, "whole")
+	send(uc, 0x82, "b") // of a queue abandoned by the whole datagram
+	if got := recv(uc); got != "whole" {
+		t.Errorf("whole datagram between fragments: got %q, want whole", got)
+	}
+	if got := recv(uc); got != "" {
+		t.Errorf("after a whole datagram: got %q, want fragments dropped", got)
+	}
+	send(other, 0, "x")
+	if got := recv(other); got != "" {
+		t.Errorf("other source: got %q, want dropped", got)
+	}
+
+	c.Close()
+	time.Sleep(50 * time.Millisecond)
+	send(uc, 0, "late")
+	if got := recv(uc); got != "" {
+		t.Errorf("after the TCP connection closed: got %q, want dropped", got)
+	}
+}
+
+func TestBind(t *testing.T) {
+	bind := func(cl *Client) (net.Conn, []byte) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go cl.Serve(l)
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write(append([]byte{5, 1, 0, 5, socks.CmdBind, 0}, socks.ParseAddr("127.0.0.1:0")...))
+		reply := make([]byte, 2+10)
+		if _, err := io.ReadFull(c, reply); err != nil {
+			t.Fatal(err)
+		}
+		return c, reply[2:]
+	}
+	closed, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cl, srv := pair(t)
+	defer srv.Shutdown(closed)
+	defer cl.Shutdown(closed)
+	c, reply := bind(cl)
+	c.Close()
+	if reply[1] != byte(socks.ErrCommandNotSupported) {
+		t.Errorf("server without BIND: got %v, want command not supported", reply)
+	}
+
+	cl, srv = pair(t)
+	srv.Bind = true
+	defer srv.Shutdown(closed)
+	defer cl.Shutdown(closed)
+	c, reply = bind(cl)
+	c.Close()
+	if reply[1] != byte(socks.ErrGeneralFailure) {
+		t.Errorf("server reached on loopback: got %v, want general failure", reply)
+	}
+
+	srv.BindAddr = "127.0.0.1"
+	c, reply = bind(cl)
+	defer c.Close()
+	if reply[1] != 0 {
+		t.Fatalf("first reply: got %v", reply)
+	}
+	pc, err := net.Dial("tcp", socks.Addr(reply[3:]).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, err := io.ReadFull(c, reply); err != nil || reply[1] != 0 || socks.Addr(reply[3:]).String() != pc.LocalAddr().String() {
+		t.Fatalf("second reply: got %v, %v, want the address of the peer %s", reply, err, pc.LocalAddr())
+	}
+	pc.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("relay: got %q, %v", buf, err)
+	}
+}
+
+// fakeRedir redirects all packets it receives to orig, and replies from src only.
+type fakeRedir struct {
+	net.PacketConn
+	orig net.Addr
+}
+
+func (c *fakeRedir) ReadFromOrig(b []byte) (int, net.Addr, net.Addr, error) {
+	n, addr, err := c.ReadFrom(b)
+	return n, addr, c.orig, err
+}
+
+func (c *fakeRedir) WriteToFrom(b []byte, addr, src net.Addr) (int, error) {
+	if src.String() != c.orig.String() {
+		return 0, errors.New("reply from " + src.String())
+	}
+	return c.WriteTo(b, addr)
+}
+
+func TestPacketRedir(t *testing.T) {
+	el, epc := echo(t)
+	defer el.Close()
+	defer epc.Close()
+	cl, srv := pair(t)
+	closed, cancel := context.WithCancel(context.Background())
+	cancel()
+	defer srv.Shutdown(closed)
+	defer cl.Shutdown(closed)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cl.ServePacketRedir(&fakeRedir{pc, epc.LocalAddr()}, nil)
+	roundTrip := func(pc net.PacketConn) {
+		uc, err := net.Dial("udp", pc.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer uc.Close()
+		uc.SetDeadline(time.Now().Add(5 * time.Second))
+		uc.Write([]byte("hello"))
+		buf := make([]byte, 16)
+		n, err := uc.Read(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			t.Errorf("got %q, %v", buf[:n], err)
+		}
+	}
+	roundTrip(pc)
+
+	// a fake address stands for localhost and is replied from
+	_, port, _ := net.SplitHostPort(epc.LocalAddr().String())
+	fake, _ := net.ResolveUDPAddr("udp", "198.18.0.1:"+port)
+	pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cl.ServePacketRedir(&fakeRedir{pc, fake}, func(tgt socks.Addr) socks.Addr {
+		if tgt.String() == fake.String() {
+			return socks.ParseAddr("localhost:" + port)
+		}
+		return tgt
+	})
+	roundTrip(pc)
+}
+
+// clientHello returns the first TLS record sent by a client connecting to name.
+func clientHello(name string) []byte {
+	c, peer := net.Pipe()
+	defer c.Close()
+	defer peer.Close()
+	go tls.Client(c, &tls.Config{ServerName: name}).Handshake()
+	h := make([]byte, 5)
+	if _, err := io.ReadFull(peer, h); err != nil {
+		return nil
+	}
+	rec := make([]byte, 5+(int(h[3])<<8|int(h[4])))
+	copy(rec, h)
+	if _, err := io.ReadFull(peer, rec[5:]); err != nil {
+		return nil
+	}
+	return rec
+}
+
+func TestSniff(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		write func(c net.Conn)
+		want  string
+	}{
+		{"TLS", func(c net.Conn) {
+			tls.Client(c, &tls.Config{ServerName: "Example.COM"}).Handshake()
+		}, "example.com"},
+		{"TLS in two records", func(c net.Conn) {
+			hello := clientHello("split.example.com")[5:]
+			for _, b := range [][]byte{hello[:40], hello[40:]} {
+				c.Write(append([]byte{0x16, 3, 1, byte(len(b) >> 8), byte(len(b))}, b...))
+			}
+		}, "split.example.com"},
+		{"TLS without SNI", func(c net.Conn) {
+			tls.Client(c, &tls.Config{InsecureSkipVerify: true}).Handshake()
+		}, ""},
+		{"HTTP", func(c net.Conn) {
+			io.WriteString(c, "GET / HTTP/1.1\r\n")
+			time.Sleep(10 * time.Millisecond)
+			io.WriteString(c, "User-Agent: test\r\nhost: www.example.com:8080\r\n\r\n")
+		}, "www.example.com"},
+		{"HTTP to IP", func(c net.Conn) {
+			io.WriteString(c, "GET / HTTP/1.1\r\nHost: 10.0.0.1\r\n\r\n")
+		}, ""},
+		{"SSH", func(c net.Conn) {
+			io.WriteString(c, "SSH-2.0-OpenSSH_8.4\r\n")
+		}, ""},
+		{"server first", func(c net.Conn) {}, ""},
+	} {
+		c, peer := net.Pipe()
+		go tt.write(peer)
+		br := bufio.NewReaderSize(c, maxRecordLen)
+		if got := sniff(c, br); got != tt.want {
+			t.Errorf("%s: sniffed %q, want %q", tt.name, got, tt.want)
+		}
+		c.Close()
+		peer.Close()
+	}
+}
+
+func TestACL(t *testing.T) {
+	el, epc := echo(t)
+	defer el.Close()
+	defer epc.Close()
+	cl, srv := pair(t)
+	closed, cancel := context.WithCancel(context.Background())
+	cancel()
+	defer srv.Shutdown(closed)
+	defer cl.Shutdown(closed)
+	_, port, _ := net.SplitHostPort(el.Addr().String())
+
+	tunnel := func(tgt string) bool {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go cl.ServeTunnel(l, socks.ParseAddr(tgt))
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		// denied connections are only closed once the relay gives up on the other direction
+		c.SetDeadline(time.Now().Add(time.Second))
+		c.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(c, buf)
+		return err == nil
+	}
+
+	if !tunnel(el.Addr().String()) || !tunnel("localhost:"+port) {
+		t.Error("allowed loopback denied")
+	}
+	for _, rules := range []string{"", "FINAL,allow", "DOMAIN,localhost,allow"} {
+		acl, err := route.ParseACL(strings.NewReader(rules), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.SetACL(acl)
+		if tunnel(el.Addr().String()) || tunnel("localhost:"+port) {
+			t.Errorf("loopback allowed by %q", rules)
+		}
+	}
+	srv.SetACL(nil)
+	if tunnel(el.Addr().String()) || tunnel("localhost:"+port) {
+		t.Error("loopback allowed without ACL")
+	}
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// sniffTimeout is how long to wait for the first bytes of a connection to sniff. Connections
+// whose server speaks first are relayed to the address they were sent to after it.
+const sniffTimeout = 300 * time.Millisecond
+
+// maxRecordLen is the maximum size of a TLS record, including its header. A ClientHello split
+// in several records is sniffed if they fit in this size.
+const maxRecordLen = 5 + 16384
+
+// ServeRedirect accepts connections on l and proxies them through the server like ServeFunc.
+// If Sniff is set, IP addresses returned by getAddr are replaced by the name found in the first
+// bytes sent on the connection, keeping the port.
+func (cl *Client) ServeRedirect(l net.Listener, getAddr func(net.Conn) (socks.Addr, error)) error {
+	if !cl.Sniff {
+		return cl.ServeFunc(l, getAddr)
+	}
+	return cl.t.serve(l, cl.logf, func(ctx context.Context, c net.Conn) {
+		tgt, err := getAddr(c)
+		if err == nil && tgt[0] != socks.AtypDomainName {
+			br := bufio.NewReaderSize(c, maxRecordLen)
+			if name := sniff(c, br); name != "" {
+				port := int(tgt[len(tgt)-2])<<8 | int(tgt[len(tgt)-1])
+				if a := socks.ParseAddr(net.JoinHostPort(name, strconv.Itoa(port))); a != nil {
+					cl.logf("sniffed %s for %s", name, tgt)
+					tgt = a
+				}
+			}
+			c = &bufConn{c, br}
+		}
+		cl.handle(ctx, c, func(net.Conn) (socks.Addr, string, func(error, socks.Addr) error, error) {
+			return tgt, "", nil, err
+		})
+	})
+}
+
+// sniff returns the server name of a TLS ClientHello or the Host header of an HTTP/1 request
+// peeked from br reading c, or "" if none within sniffTimeout.
+func sniff(c net.Conn, br *bufio.Reader) string {
+	c.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	b, err := br.Peek(1)
+	if err != nil {
+		return ""
+	}
+	if b[0] == 0x16 { // TLS handshake record
+		return tlsServerName(tlsHandshake(br))
+	}
+	return httpHost(br)
+}
+
+// tlsHandshake returns the handshake data of the TLS records peeked from br, reading records
+// until the first message is complete, e.g. a ClientHello split in several records, or
+// no more fit in the buffer of br.
+func tlsHandshake(br *bufio.Reader) []byte {
+	var msg []byte
+	off := 0
+	for {
+		h, err := br.Peek(off + 5)
+		if err != nil || h[off] != 0x16 {
+			return msg
+		}
+		rec, err := br.Peek(off + 5 + int(binary.BigEndian.Uint16(h[off+3:])))
+		if err != nil {
+			return msg
+		}
+		msg = append(msg, rec[off+5:]...)
+		off = len(rec)
+		// msg_type, then a 24-bit length
+		if len(msg) >= 4 && len(msg)-4 >= int(msg[1])<<16|int(msg[2])<<8|int(msg[3]) {
+			return msg
+		}
+	}
+}
+
+// tlsServerName returns the server name indication of the ClientHello starting b, or "".
+func tlsServerName(b []byte) string {
+	s := cryptobyte.String(b)
+	var typ uint8
+	var hello, sessionID, suites, compressions, exts cryptobyte.String
+	if !s.ReadUint8(&typ) || typ != 1 || !s.ReadUint24LengthPrefixed(&hello) ||
+		!hello.Skip(2+32) || // version, random
+		!hello.ReadUint8LengthPrefixed(&sessionID) ||
+		!hello.ReadUint16LengthPrefixed(&suites) ||
+		!hello.ReadUint8LengthPrefixed(&compressions) ||
+		!hello.ReadUint16LengthPrefixed(&exts) {
+		return ""
+	}
+	for !exts.Empty() {
+		var ext uint16
+		var data, names cryptobyte.String
+		if !exts.ReadUint16(&ext) || !exts.ReadUint16LengthPrefixed(&data) {
+			return ""
+		}
+		if ext != 0 { // server_name
+			continue
+		}
+		if !data.ReadUint16LengthPrefixed(&names) {
+			return ""
+		}
+		for !names.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return ""
+			}
+			if nameType == 0 { // host_name
+				return hostName(string(name))
+			}
+		}
+	}
+	return ""
+}
+
+// httpHost returns the host of the Host header of the HTTP/1 request peeked from br, or "".
+func httpHost(br *bufio.Reader) string {
+	var head []byte
+	for {
+		head, _ = br.Peek(br.Buffered())
+		if i := bytes.Index(head, []byte("\r\n")); i >= 0 && !bytes.Contains(head[:i], []byte(" HTTP/1.")) {
+			return "" // not HTTP
+		}
+		if bytes.Contains(head, []byte("\r\n\r\n")) || len(head) == br.Size() {
+			break
+		}
+		if _, err := br.Peek(len(head) + 1); err != nil {
+			return ""
+		}
+	}
+	lines := strings.Split(string(head), "\r\n")
+	for _, line := range lines[1:] {
+		if line == "" {
+			break
+		}
+		if i := strings.IndexByte(line, ':'); i >= 0 && strings.EqualFold(line[:i], "Host") {
+			host := strings.TrimSpace(line[i+1:])
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return hostName(host)
+		}
+	}
+	return ""
+}
+
+// hostName returns name in lower case without the final dot if it is a domain name, or "".
+func hostName(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name == "" || len(name) > 253 || net.ParseIP(name) != nil {
+		return ""
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return ""
+		}
+	}
+	return name
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// ErrServerClosed is returned by the Serve methods of Client and Server after Shutdown.
+var ErrServerClosed = errors.New("service: server closed")
+
+// tracker keeps the listeners and active sessions of a Client or Server for Shutdown.
+type tracker struct {
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	packets   map[net.PacketConn]struct{} // closed only after draining, as sessions reply through them
+	sessions  map[io.Closer]struct{}      // TCP connections and UDP NAT sockets
+	closing   bool
+	idle      chan struct{} // closed when sessions becomes empty while closing
+
+	// ctx of all sessions, cancelled when closing them at the end of Shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (t *tracker) init() {
+	if t.sessions == nil {
+		t.ctx, t.cancel = context.WithCancel(context.Background())
+		t.listeners = make(map[net.Listener]struct{})
+		t.packets = make(map[net.PacketConn]struct{})
+		t.sessions = make(map[io.Closer]struct{})
+	}
+}
+
+// addListener reports false if shutting down.
+func (t *tracker) addListener(l net.Listener) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	if t.closing {
+		return false
+	}
+	t.listeners[l] = struct{}{}
+	return true
+}
+
+func (t *tracker) removeListener(l net.Listener) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.listeners, l)
+}
+
+// addPacket reports false if shutting down.
+func (t *tracker) addPacket(pc net.PacketConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	if t.closing {
+		return false
+	}
+	t.packets[pc] = struct{}{}
+	return true
+}
+
+func (t *tracker) removePacket(pc net.PacketConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.packets, pc)
+}
+
+// add starts tracking a session and returns its context, or nil if shutting down.
+func (t *tracker) add(c io.Closer) context.Context {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	if t.closing {
+		return nil
+	}
+	t.sessions[c] = struct{}{}
+	return t.ctx
+}
+
+func (t *tracker) done(c io.Closer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, c)
+	if len(t.sessions) == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+func (t *tracker) isClosing() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closing
+}
+
+// shutdown closes all listeners and waits for active sessions to end, or closes them when
+// ctx is done.
+func (t *tracker) shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.init()
+	t.closing = true
+	for l := range t.listeners {
+		l.Close()
+	}
+	idle := make(chan struct{})
+	if len(t.sessions) == 0 {
+		close(idle)
+	} else {
+		t.idle = idle
+	}
+	t.mu.Unlock()
+
+	var err error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		t.mu.Lock()
+		t.cancel()
+		for c := range t.sessions {
+			c.Close()
+		}
+		if n := len(t.sessions); n > 0 {
+			err = fmt.Errorf("closed %d active sessions: %w", n, ctx.Err())
+		}
+		t.mu.Unlock()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cancel()
+	for pc := range t.packets {
+		pc.Close()
+	}
+	return err
+}
+
+// serve accepts connections on l and handles each in a new goroutine until l is closed.
+func (t *tracker) serve(l net.Listener, logf func(string, ...interface{}), handle func(context.Context, net.Conn)) error {
+	if !t.addListener(l) {
+		return ErrServerClosed
+	}
+	defer t.removeListener(l)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if t.isClosing() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			logf("failed to accept: %v", err)
+			continue
+		}
+		ctx := t.add(c)
+		if ctx == nil {
+			c.Close()
+			continue
+		}
+		go func() {
+			defer t.done(c)
+			defer c.Close()
+			handle(ctx, c)
+		}()
+	}
+}
@@ -0,0 +1,101 @@
+package shadowaead2022
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"strconv"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/blake3"
+)
+
+// ErrRepeatedSalt means detected a reused salt
+var ErrRepeatedSalt = errors.New("repeated salt detected")
+
+// ErrBadTimestamp means the timestamp in a header is too far away from local clock
+var ErrBadTimestamp = errors.New("time difference too large")
+
+// ErrBadHeader means a header has unexpected type or content
+var ErrBadHeader = errors.New("bad header")
+
+type Cipher interface {
+	KeySize() int
+	SaltSize() int
+	Encrypter(salt []byte) (cipher.AEAD, error)
+	Decrypter(salt []byte) (cipher.AEAD, error)
+	// PacketAEAD returns the AEAD protecting packets of the given session.
+	PacketAEAD(sessionID []byte) (cipher.AEAD, error)
+	// HeaderBlock returns the block cipher encrypting the separate header
+	// of packets, or nil if packets are sealed as a whole.
+	HeaderBlock() cipher.Block
+}
+
+type KeySizeError int
+
+func (e KeySizeError) Error() string {
+	return "key size error: need " + strconv.Itoa(int(e)) + " bytes"
+}
+
+func deriveSubkey(psk, salt []byte) []byte {
+	material := make([]byte, len(psk)+len(salt))
+	copy(material, psk)
+	copy(material[len(psk):], salt)
+	subkey := make([]byte, len(psk))
+	blake3.DeriveKey(subkey, "shadowsocks 2022 session subkey", material)
+	return subkey
+}
+
+type metaCipher struct {
+	psk      []byte
+	makeAEAD func(key []byte) (cipher.AEAD, error)
+	block    cipher.Block
+}
+
+func (a *metaCipher) KeySize() int  { return len(a.psk) }
+func (a *metaCipher) SaltSize() int { return len(a.psk) }
+func (a *metaCipher) Encrypter(salt []byte) (cipher.AEAD, error) {
+	return a.makeAEAD(deriveSubkey(a.psk, salt))
+}
+func (a *metaCipher) Decrypter(salt []byte) (cipher.AEAD, error) {
+	return a.makeAEAD(deriveSubkey(a.psk, salt))
+}
+func (a *metaCipher) PacketAEAD(sessionID []byte) (cipher.AEAD, error) {
+	if a.block == nil {
+		return chacha20poly1305.NewX(a.psk)
+	}
+	return a.makeAEAD(deriveSubkey(a.psk, sessionID))
+}
+func (a *metaCipher) HeaderBlock() cipher.Block { return a.block }
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
+
+// AESGCM creates a new Cipher with a pre-shared key. len(psk) must be
+// either 16 or 32 to select 2022-blake3-aes-128-gcm or 2022-blake3-aes-256-gcm.
+func AESGCM(psk []byte) (Cipher, error) {
+	switch l := len(psk); l {
+	case 16, 32:
+	default:
+		return nil, aes.KeySizeError(l)
+	}
+	blk, err := aes.NewCipher(psk)
+	if err != nil {
+		return nil, err
+	}
+	return &metaCipher{psk: psk, makeAEAD: aesGCM, block: blk}, nil
+}
+
+// Chacha20Poly1305 creates a new Cipher with a pre-shared key. len(psk)
+// must be 32.
+func Chacha20Poly1305(psk []byte) (Cipher, error) {
+	if len(psk) != chacha20poly1305.KeySize {
+		return nil, KeySizeError(chacha20poly1305.KeySize)
+	}
+	return &metaCipher{psk: psk, makeAEAD: chacha20poly1305.New}, nil
+}
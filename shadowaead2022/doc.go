@@ -0,0 +1,51 @@
+/*
+Package shadowaead2022 implements the Shadowsocks 2022 Edition (SIP022) AEAD protocol.
+
+Compared to package shadowaead, keys are never derived from passwords and must be
+exactly KeySize() bytes long. Session subkeys are derived with BLAKE3:
+
+	session_subkey := blake3::derive_key(context: "shadowsocks 2022 session subkey", key_material: key + salt)
+
+A request stream starts with a random salt of key size, followed by a fixed-length header chunk,
+a variable-length header chunk and then any number of encrypted records:
+
+	[salt]
+	[encrypted fixed-length header][tag]        type (0), timestamp, length of variable-length header
+	[encrypted variable-length header][tag]     SOCKS address, padding length, padding, initial payload
+	[encrypted payload length][tag]
+	[encrypted payload][tag]
+	...
+
+A response stream echoes the request salt in its fixed-length header, which also carries the length
+of the first payload chunk:
+
+	[salt]
+	[encrypted fixed-length header][tag]        type (1), timestamp, request salt, length of first payload
+	[encrypted payload][tag]
+	[encrypted payload length][tag]
+	[encrypted payload][tag]
+	...
+
+Payload length is 2-byte unsigned big-endian integer capped at 0xFFFF. The timestamp is a
+big-endian Unix epoch in seconds and must be within 30 seconds of the receiver's clock.
+The nonce is a counter starting from 0 shared by all chunks of a stream, incremented by one
+after each encrypt/decrypt operation as if it were an unsigned little-endian integer.
+
+Each packet is tied to a session identified by a random 8-byte session ID and carries an
+8-byte packet ID counting from 0. With AES-GCM, packets have the following structure:
+
+	[separate header encrypted with AES-ECB using the key]   session ID, packet ID
+	[encrypted main header and payload][tag]
+
+The AEAD of a packet uses a subkey derived from the key and session ID, and the last 12 bytes
+of the separate header as nonce. With ChaCha20-Poly1305, packets are sealed as a whole with
+XChaCha20-Poly1305 using the key directly and a random 24-byte nonce:
+
+	[nonce]
+	[encrypted session ID, packet ID, main header and payload][tag]
+
+The main header of a client packet contains type (0), timestamp, padding length, padding and
+the SOCKS address of the target. Server packets additionally carry the client session ID
+right after the timestamp.
+*/
+package shadowaead2022
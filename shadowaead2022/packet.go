@@ -0,0 +1,273 @@
+package shadowaead2022
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrShortPacket means that the packet is too short for a valid encrypted packet.
+var ErrShortPacket = errors.New("short packet")
+
+// ErrRepeatedPacket means detected a reused packet ID
+var ErrRepeatedPacket = errors.New("repeated packet detected")
+
+const (
+	separateHeaderSize = 8 + 8 // session ID, packet ID
+	xNonceSize         = 24
+)
+
+// sessionTimeout is how long a remote session is remembered after its last packet.
+const sessionTimeout = 5 * time.Minute
+
+type localSession struct {
+	id       uint64
+	packetID uint64
+	aead     cipher.AEAD
+}
+
+type remoteSession struct {
+	id       uint64
+	aead     cipher.AEAD
+	filter   slidingWindow
+	lastSeen time.Time
+	reply    *localSession // server only: session used to reply to the client
+}
+
+// packetConn plays the server role towards peers sending client packets and the client role otherwise.
+type packetConn struct {
+	net.PacketConn
+	Cipher
+	sync.Mutex
+	buf       []byte // write lock
+	local     *localSession
+	remotes   map[uint64]*remoteSession
+	peers     map[string]*remoteSession // server only: client sessions by address
+	lastPrune time.Time
+}
+
+// NewPacketConn wraps a net.PacketConn with cipher
+func NewPacketConn(c net.PacketConn, ciph Cipher) net.PacketConn {
+	const maxPacketSize = 64 * 1024
+	return &packetConn{
+		PacketConn: c,
+		Cipher:     ciph,
+		buf:        make([]byte, maxPacketSize),
+		remotes:    make(map[uint64]*remoteSession),
+		peers:      make(map[string]*remoteSession),
+	}
+}
+
+func (c *packetConn) newLocalSession() (*localSession, error) {
+	var id [8]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return nil, err
+	}
+	aead, err := c.PacketAEAD(id[:])
+	if err != nil {
+		return nil, err
+	}
+	return &localSession{id: binary.BigEndian.Uint64(id[:]), aead: aead}, nil
+}
+
+// pack encrypts plaintext in session s and returns a slice of dst containing the encrypted packet.
+// A server packet of type headerTypeServer also carries the client session ID.
+func (c *packetConn) pack(dst, plaintext []byte, s *localSession, typ byte, clientID uint64) ([]byte, error) {
+	mainHeaderSize := 1 + 8 + 2
+	if typ == headerTypeServer {
+		mainHeaderSize += 8
+	}
+	block := c.HeaderBlock()
+	prefixSize := separateHeaderSize
+	if block == nil {
+		prefixSize = xNonceSize + separateHeaderSize
+	}
+	if len(dst) < prefixSize+mainHeaderSize+len(plaintext)+s.aead.Overhead() {
+		return nil, io.ErrShortBuffer
+	}
+
+	hdr := dst[prefixSize-separateHeaderSize : prefixSize]
+	binary.BigEndian.PutUint64(hdr, s.id)
+	binary.BigEndian.PutUint64(hdr[8:], s.packetID)
+	s.packetID++
+
+	b := dst[prefixSize : prefixSize+mainHeaderSize]
+	b[0] = typ
+	putTimestamp(b[1:])
+	if typ == headerTypeServer {
+		binary.BigEndian.PutUint64(b[9:], clientID)
+	}
+	binary.BigEndian.PutUint16(b[mainHeaderSize-2:], 0) // no padding
+	n := prefixSize + mainHeaderSize + copy(dst[prefixSize+mainHeaderSize:], plaintext)
+
+	if block == nil {
+		nonce := dst[:xNonceSize]
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		b = s.aead.Seal(dst[xNonceSize:xNonceSize], nonce, dst[xNonceSize:n], nil)
+		return dst[:xNonceSize+len(b)], nil
+	}
+	b = s.aead.Seal(dst[prefixSize:prefixSize], hdr[4:], dst[prefixSize:n], nil)
+	block.Encrypt(hdr, hdr)
+	return dst[:prefixSize+len(b)], nil
+}
+
+// unpack decrypts pkt in place and returns the session and packet IDs, the authenticated
+// main header and payload.
+func (c *packetConn) unpack(pkt []byte) (sid, pid uint64, aead cipher.AEAD, b []byte, err error) {
+	block := c.HeaderBlock()
+	if block == nil {
+		if len(pkt) < xNonceSize+separateHeaderSize {
+			return 0, 0, nil, nil, ErrShortPacket
+		}
+		if aead, err = c.PacketAEAD(nil); err != nil {
+			return
+		}
+		if b, err = aead.Open(pkt[xNonceSize:xNonceSize], pkt[:xNonceSize], pkt[xNonceSize:], nil); err != nil {
+			return
+		}
+		if len(b) < separateHeaderSize {
+			return 0, 0, nil, nil, ErrShortPacket
+		}
+		sid, pid = binary.BigEndian.Uint64(b), binary.BigEndian.Uint64(b[8:])
+		return sid, pid, aead, b[separateHeaderSize:], nil
+	}
+
+	if len(pkt) < separateHeaderSize {
+		return 0, 0, nil, nil, ErrShortPacket
+	}
+	hdr := pkt[:separateHeaderSize]
+	block.Decrypt(hdr, hdr)
+	sid, pid = binary.BigEndian.Uint64(hdr), binary.BigEndian.Uint64(hdr[8:])
+	c.Lock()
+	if s, ok := c.remotes[sid]; ok {
+		aead = s.aead
+	}
+	c.Unlock()
+	if aead == nil {
+		if aead, err = c.PacketAEAD(hdr[:8]); err != nil {
+			return
+		}
+	}
+	b, err = aead.Open(pkt[separateHeaderSize:separateHeaderSize], hdr[4:], pkt[separateHeaderSize:], nil)
+	return sid, pid, aead, b, err
+}
+
+// WriteTo encrypts b and write to addr using the embedded PacketConn.
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	var buf []byte
+	var err error
+	if peer, ok := c.peers[addr.String()]; ok {
+		buf, err = c.pack(c.buf, b, peer.reply, headerTypeServer, peer.id)
+	} else {
+		if c.local == nil {
+			if c.local, err = c.newLocalSession(); err != nil {
+				return 0, err
+			}
+		}
+		buf, err = c.pack(c.buf, b, c.local, headerTypeClient, 0)
+	}
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.PacketConn.WriteTo(buf, addr)
+	return len(b), err
+}
+
+// ReadFrom reads from the embedded PacketConn and decrypts into b.
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	sid, pid, aead, bb, err := c.unpack(b[:n])
+	if err != nil {
+		return n, addr, err
+	}
+
+	// main header: type, timestamp, [client session ID], padding length, padding
+	if len(bb) < 1+8 {
+		return n, addr, ErrShortPacket
+	}
+	typ := bb[0]
+	if err := checkTimestamp(bb[1:9]); err != nil {
+		return n, addr, err
+	}
+	bb = bb[9:]
+	var clientID uint64
+	if typ == headerTypeServer {
+		if len(bb) < 8 {
+			return n, addr, ErrShortPacket
+		}
+		clientID = binary.BigEndian.Uint64(bb)
+		bb = bb[8:]
+	}
+	if len(bb) < 2 {
+		return n, addr, ErrShortPacket
+	}
+	padding := int(binary.BigEndian.Uint16(bb))
+	if len(bb) < 2+padding {
+		return n, addr, ErrShortPacket
+	}
+	bb = bb[2+padding:]
+
+	c.Lock()
+	defer c.Unlock()
+	switch typ {
+	case headerTypeClient:
+	case headerTypeServer:
+		if c.local == nil || clientID != c.local.id {
+			return n, addr, ErrBadHeader
+		}
+	default:
+		return n, addr, ErrBadHeader
+	}
+
+	now := time.Now()
+	s, ok := c.remotes[sid]
+	if !ok {
+		s = &remoteSession{id: sid, aead: aead}
+		if typ == headerTypeClient {
+			if s.reply, err = c.newLocalSession(); err != nil {
+				return n, addr, err
+			}
+		}
+	}
+	if !s.filter.Validate(pid) {
+		return n, addr, ErrRepeatedPacket
+	}
+	s.lastSeen = now
+	c.remotes[sid] = s
+	if typ == headerTypeClient {
+		c.peers[addr.String()] = s
+	}
+	c.prune(now)
+
+	return copy(b, bb), addr, nil
+}
+
+// prune forgets remote sessions that have been idle for too long.
+func (c *packetConn) prune(now time.Time) {
+	if now.Sub(c.lastPrune) < time.Minute {
+		return
+	}
+	for id, s := range c.remotes {
+		if now.Sub(s.lastSeen) > sessionTimeout {
+			delete(c.remotes, id)
+		}
+	}
+	for k, s := range c.peers {
+		if _, ok := c.remotes[s.id]; !ok {
+			delete(c.peers, k)
+		}
+	}
+	c.lastPrune = now
+}
@@ -0,0 +1,95 @@
+package shadowaead2022
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// maxTimeDiff is the maximum allowed difference between a header timestamp and local clock.
+const maxTimeDiff = 30
+
+func putTimestamp(b []byte) { binary.BigEndian.PutUint64(b, uint64(time.Now().Unix())) }
+
+func checkTimestamp(b []byte) error {
+	diff := time.Now().Unix() - int64(binary.BigEndian.Uint64(b))
+	if diff < -maxTimeDiff || diff > maxTimeDiff {
+		return ErrBadTimestamp
+	}
+	return nil
+}
+
+// saltTTL is how long a salt is remembered. It must be at least twice maxTimeDiff
+// so that a replayed stream is rejected either by its timestamp or by its salt.
+const saltTTL = 2 * maxTimeDiff * time.Second
+
+// saltPool remembers recently seen salts.
+type saltPool struct {
+	sync.Mutex
+	m         map[string]time.Time // salt -> expiry
+	lastPrune time.Time
+}
+
+// A shared instance used for checking salt repeat
+var salts = &saltPool{m: make(map[string]time.Time)}
+
+func (p *saltPool) prune(now time.Time) {
+	if now.Sub(p.lastPrune) < saltTTL {
+		return
+	}
+	for k, exp := range p.m {
+		if now.After(exp) {
+			delete(p.m, k)
+		}
+	}
+	p.lastPrune = now
+}
+
+// Check returns true if salt is repeated, otherwise salt is added to pool.
+func (p *saltPool) Check(salt []byte) bool {
+	now := time.Now()
+	p.Lock()
+	defer p.Unlock()
+	p.prune(now)
+	if exp, ok := p.m[string(salt)]; ok && now.Before(exp) {
+		return true
+	}
+	p.m[string(salt)] = now.Add(saltTTL)
+	return false
+}
+
+const (
+	windowBlockBits = 64
+	windowBlocks    = 16
+	windowSize      = (windowBlocks - 1) * windowBlockBits
+)
+
+// slidingWindow is a packet ID filter rejecting duplicates and IDs too far behind the latest one,
+// as described in RFC 6479.
+type slidingWindow struct {
+	last uint64
+	ring [windowBlocks]uint64
+}
+
+// Validate returns true and marks id as received if id has not been seen before.
+func (w *slidingWindow) Validate(id uint64) bool {
+	block := id / windowBlockBits
+	if id > w.last {
+		current := w.last / windowBlockBits
+		diff := block - current
+		if diff > windowBlocks {
+			diff = windowBlocks
+		}
+		for i := current + 1; i <= current+diff; i++ {
+			w.ring[i%windowBlocks] = 0
+		}
+		w.last = id
+	} else if w.last-id > windowSize {
+		return false
+	}
+	block %= windowBlocks
+	bit := uint64(1) << (id % windowBlockBits)
+	old := w.ring[block]
+	w.ring[block] = old | bit
+	return old&bit == 0
+}
@@ -0,0 +1,274 @@
+package shadowaead2022_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead2022"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func ciphers(t *testing.T) map[string]shadowaead2022.Cipher {
+	aes128, err := shadowaead2022.AESGCM(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aes256, err := shadowaead2022.AESGCM(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chacha, err := shadowaead2022.Chacha20Poly1305(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]shadowaead2022.Cipher{"aes-128-gcm": aes128, "aes-256-gcm": aes256, "chacha20-poly1305": chacha}
+}
+
+func TestStream(t *testing.T) {
+	tgt := socks.ParseAddr("example.com:443")
+	request := bytes.Repeat([]byte("request"), 20000)
+	response := bytes.Repeat([]byte("response"), 20000)
+
+	for name, ciph := range ciphers(t) {
+		t.Run(name, func(t *testing.T) {
+			left, right := net.Pipe()
+			client := shadowaead2022.NewConn(left, ciph)
+			server := shadowaead2022.NewConn(right, ciph)
+			defer client.Close()
+			defer server.Close()
+
+			errc := make(chan error, 1)
+			go func() {
+				if _, err := client.Write(tgt); err != nil {
+					errc <- err
+					return
+				}
+				_, err := client.Write(request)
+				errc <- err
+			}()
+
+			addr, err := socks.ReadAddr(server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.String() != tgt.String() {
+				t.Fatalf("got target %v, want %v", addr, tgt)
+			}
+			got := make([]byte, len(request))
+			if _, err := io.ReadFull(server, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, request) {
+				t.Fatal("request mismatch")
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			go func() {
+				_, err := server.Write(response)
+				errc <- err
+			}()
+			got = make([]byte, len(response))
+			if _, err := io.ReadFull(client, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, response) {
+				t.Fatal("response mismatch")
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestStreamRequiresTarget(t *testing.T) {
+	left, right := net.Pipe()
+	defer right.Close()
+	client := shadowaead2022.NewConn(left, ciphers(t)["aes-128-gcm"])
+	defer client.Close()
+	if _, err := client.Write([]byte{0xff}); err == nil {
+		t.Fatal("expect error writing without target address")
+	}
+}
+
+func TestPacket(t *testing.T) {
+	tgt := socks.ParseAddr("8.8.8.8:53")
+	for name, ciph := range ciphers(t) {
+		t.Run(name, func(t *testing.T) {
+			sc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := shadowaead2022.NewPacketConn(sc, ciph)
+			client := shadowaead2022.NewPacketConn(cc, ciph)
+			defer server.Close()
+			defer client.Close()
+
+			for i := 0; i < 3; i++ {
+				if _, err := client.WriteTo(append(tgt, "query"...), sc.LocalAddr()); err != nil {
+					t.Fatal(err)
+				}
+				buf := make([]byte, 64*1024)
+				n, raddr, err := server.ReadFrom(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := append(tgt, "query"...); !bytes.Equal(buf[:n], want) {
+					t.Fatalf("server got %q, want %q", buf[:n], want)
+				}
+
+				if _, err := server.WriteTo(append(tgt, "answer"...), raddr); err != nil {
+					t.Fatal(err)
+				}
+				n, _, err = client.ReadFrom(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := append(tgt, "answer"...); !bytes.Equal(buf[:n], want) {
+					t.Fatalf("client got %q, want %q", buf[:n], want)
+				}
+			}
+		})
+	}
+}
+
+// bufConn reads from r and writes to w.
+type bufConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *bufConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *bufConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+func (c *bufConn) Close() error                { return nil }
+
+// request returns the start of a stream with a header of type typ and timestamp ts, followed by
+// the request salt of a response if not nil.
+func request(t *testing.T, ciph shadowaead2022.Cipher, typ byte, ts time.Time, reqSalt []byte) []byte {
+	salt := make([]byte, ciph.SaltSize())
+	if _, err := rand.Read(salt); err != nil {
+		t.Fatal(err)
+	}
+	aead, err := ciph.Encrypter(salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vh := append(socks.ParseAddr("example.com:443"), 0, 0)
+	hdr := make([]byte, 1+8+len(reqSalt)+2)
+	hdr[0] = typ
+	binary.BigEndian.PutUint64(hdr[1:], uint64(ts.Unix()))
+	copy(hdr[9:], reqSalt)
+	binary.BigEndian.PutUint16(hdr[len(hdr)-2:], uint16(len(vh)))
+
+	nonce := make([]byte, aead.NonceSize())
+	b := aead.Seal(salt, nonce, hdr, nil)
+	nonce[0]++
+	return aead.Seal(b, nonce, vh, nil)
+}
+
+func TestStreamReplay(t *testing.T) {
+	ciph := ciphers(t)["aes-128-gcm"]
+	read := func(req []byte) error {
+		server := shadowaead2022.NewConn(&bufConn{r: bytes.NewReader(req)}, ciph)
+		_, err := socks.ReadAddr(server)
+		return err
+	}
+
+	req := request(t, ciph, 0, time.Now(), nil)
+	if err := read(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := read(req); err != shadowaead2022.ErrRepeatedSalt {
+		t.Errorf("replayed request: got %v, want %v", err, shadowaead2022.ErrRepeatedSalt)
+	}
+	for _, ts := range []time.Time{time.Now().Add(-time.Minute), time.Now().Add(time.Minute)} {
+		if err := read(request(t, ciph, 0, ts, nil)); err != shadowaead2022.ErrBadTimestamp {
+			t.Errorf("timestamp %v: got %v, want %v", ts, err, shadowaead2022.ErrBadTimestamp)
+		}
+	}
+	if err := read(request(t, ciph, 1, time.Now(), nil)); err != shadowaead2022.ErrBadHeader {
+		t.Errorf("server header: got %v, want %v", err, shadowaead2022.ErrBadHeader)
+	}
+
+	// a client must get a response header
+	resp := request(t, ciph, 0, time.Now(), make([]byte, ciph.SaltSize()))
+	client := shadowaead2022.NewConn(&bufConn{r: bytes.NewReader(resp), w: io.Discard}, ciph)
+	if _, err := client.Write(socks.ParseAddr("example.com:443")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != shadowaead2022.ErrBadHeader {
+		t.Errorf("client header: got %v, want %v", err, shadowaead2022.ErrBadHeader)
+	}
+}
+
+func TestPacketReplay(t *testing.T) {
+	tgt := socks.ParseAddr("8.8.8.8:53")
+	for name, ciph := range ciphers(t) {
+		t.Run(name, func(t *testing.T) {
+			listen := func() net.PacketConn {
+				pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				pc.SetDeadline(time.Now().Add(5 * time.Second))
+				return pc
+			}
+			sc, cc, raw := listen(), listen(), listen()
+			server := shadowaead2022.NewPacketConn(sc, ciph)
+			client := shadowaead2022.NewPacketConn(cc, ciph)
+			defer server.Close()
+			defer client.Close()
+			defer raw.Close()
+
+			// capture a client packet, then deliver it twice
+			if _, err := client.WriteTo(append(tgt, "query"...), raw.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 64*1024)
+			n, _, err := raw.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pkt := append([]byte(nil), buf[:n]...)
+			for i := 0; i < 2; i++ {
+				if _, err := raw.WriteTo(pkt, sc.LocalAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, _, err := server.ReadFrom(buf); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := server.ReadFrom(buf); err != shadowaead2022.ErrRepeatedPacket {
+				t.Errorf("replayed packet: got %v, want %v", err, shadowaead2022.ErrRepeatedPacket)
+			}
+
+			// a reply to another client session is refused
+			other := shadowaead2022.NewPacketConn(listen(), ciph)
+			defer other.Close()
+			if _, err := server.WriteTo(append(tgt, "answer"...), raw.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			if n, _, err = raw.ReadFrom(buf); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := raw.WriteTo(buf[:n], other.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := other.ReadFrom(buf); err != shadowaead2022.ErrBadHeader {
+				t.Errorf("reply to another session: got %v, want %v", err, shadowaead2022.ErrBadHeader)
+			}
+		})
+	}
+}
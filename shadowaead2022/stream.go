@@ -0,0 +1,406 @@
+package shadowaead2022
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// payloadSizeMask is the maximum size of payload in bytes.
+const payloadSizeMask = 0xFFFF
+
+// maxPaddingLength is the maximum size of padding in a request header.
+const maxPaddingLength = 900
+
+// Header types
+const (
+	headerTypeClient = 0
+	headerTypeServer = 1
+)
+
+var errMissingAddr = errors.New("first write must start with target address")
+
+type writer struct {
+	io.Writer
+	cipher.AEAD
+	nonce []byte
+	buf   []byte
+
+	// salt and fixed-length header sent before the first chunk, if any
+	salt   []byte
+	header []byte
+}
+
+func newWriter(w io.Writer, aead cipher.AEAD) *writer {
+	return &writer{
+		Writer: w,
+		AEAD:   aead,
+		buf:    make([]byte, 2+aead.Overhead()+payloadSizeMask+aead.Overhead()),
+		nonce:  make([]byte, aead.NonceSize()),
+	}
+}
+
+// seal encrypts b in place. Ensure cap(b) >= len(b) + w.Overhead().
+func (w *writer) seal(b []byte) {
+	w.Seal(b[:0], w.nonce, b, nil)
+	increment(w.nonce)
+}
+
+// writeHeader writes salt and fixed-length header followed by the first chunk.
+// The length of the first chunk is stored in the last 2 bytes of the header.
+func (w *writer) writeHeader(chunk []byte) error {
+	buf := make([]byte, len(w.salt)+len(w.header)+w.Overhead()+len(chunk)+w.Overhead())
+	n := copy(buf, w.salt)
+
+	h := buf[n : n+len(w.header)]
+	copy(h, w.header)
+	binary.BigEndian.PutUint16(h[len(h)-2:], uint16(len(chunk)))
+	w.seal(h)
+	n += len(h) + w.Overhead()
+
+	p := buf[n : n+len(chunk)]
+	copy(p, chunk)
+	w.seal(p)
+
+	w.salt, w.header = nil, nil
+	_, err := w.Writer.Write(buf)
+	return err
+}
+
+// Write encrypts b and writes to the embedded io.Writer.
+func (w *writer) Write(b []byte) (int, error) {
+	n, err := w.ReadFrom(bytes.NewBuffer(b))
+	return int(n), err
+}
+
+// ReadFrom reads from the given io.Reader until EOF or error, encrypts and
+// writes to the embedded io.Writer. Returns number of bytes read from r and
+// any error encountered.
+func (w *writer) ReadFrom(r io.Reader) (n int64, err error) {
+	for {
+		buf := w.buf
+		payloadBuf := buf[2+w.Overhead() : 2+w.Overhead()+payloadSizeMask]
+		nr, er := r.Read(payloadBuf)
+
+		if nr > 0 {
+			n += int64(nr)
+			var ew error
+			if w.header != nil {
+				ew = w.writeHeader(payloadBuf[:nr])
+			} else {
+				buf = buf[:2+w.Overhead()+nr+w.Overhead()]
+				payloadBuf = payloadBuf[:nr]
+				binary.BigEndian.PutUint16(buf, uint16(nr))
+				w.seal(buf[:2])
+				w.seal(payloadBuf)
+				_, ew = w.Writer.Write(buf)
+			}
+			if ew != nil {
+				err = ew
+				break
+			}
+		}
+
+		if er != nil {
+			if er != io.EOF { // ignore EOF as per io.ReaderFrom contract
+				err = er
+			}
+			break
+		}
+	}
+
+	return n, err
+}
+
+type reader struct {
+	io.Reader
+	cipher.AEAD
+	nonce    []byte
+	buf      []byte
+	leftover []byte
+}
+
+func newReader(r io.Reader, aead cipher.AEAD) *reader {
+	return &reader{
+		Reader: r,
+		AEAD:   aead,
+		buf:    make([]byte, payloadSizeMask+aead.Overhead()),
+		nonce:  make([]byte, aead.NonceSize()),
+	}
+}
+
+// readChunk reads and decrypts a chunk of size bytes into the internal buffer.
+func (r *reader) readChunk(size int) ([]byte, error) {
+	buf := r.buf[:size+r.Overhead()]
+	if _, err := io.ReadFull(r.Reader, buf); err != nil {
+		return nil, err
+	}
+	_, err := r.Open(buf[:0], r.nonce, buf, nil)
+	increment(r.nonce)
+	return buf[:size], err
+}
+
+// read and decrypt a record into the internal buffer. Return decrypted payload length and any error encountered.
+func (r *reader) read() (int, error) {
+	buf, err := r.readChunk(2)
+	if err != nil {
+		return 0, err
+	}
+	buf, err = r.readChunk(int(binary.BigEndian.Uint16(buf)))
+	return len(buf), err
+}
+
+// Read reads from the embedded io.Reader, decrypts and writes to b.
+func (r *reader) Read(b []byte) (int, error) {
+	// copy decrypted bytes (if any) from previous record first
+	if len(r.leftover) > 0 {
+		n := copy(b, r.leftover)
+		r.leftover = r.leftover[n:]
+		return n, nil
+	}
+
+	n, err := r.read()
+	m := copy(b, r.buf[:n])
+	if m < n { // insufficient len(b), keep leftover for next read
+		r.leftover = r.buf[m:n]
+	}
+	return m, err
+}
+
+// WriteTo reads from the embedded io.Reader, decrypts and writes to w until
+// there's no more data to write or when an error occurs. Return number of
+// bytes written to w and any error encountered.
+func (r *reader) WriteTo(w io.Writer) (n int64, err error) {
+	// write decrypted bytes left over from previous record
+	for len(r.leftover) > 0 {
+		nw, ew := w.Write(r.leftover)
+		r.leftover = r.leftover[nw:]
+		n += int64(nw)
+		if ew != nil {
+			return n, ew
+		}
+	}
+
+	for {
+		nr, er := r.read()
+		if nr > 0 {
+			nw, ew := w.Write(r.buf[:nr])
+			n += int64(nw)
+
+			if ew != nil {
+				err = ew
+				break
+			}
+		}
+
+		if er != nil {
+			if er != io.EOF { // ignore EOF as per io.Copy contract (using src.WriteTo shortcut)
+				err = er
+			}
+			break
+		}
+	}
+
+	return n, err
+}
+
+// increment little-endian encoded unsigned integer b. Wrap around on overflow.
+func increment(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
+
+// streamConn plays the client role if it writes before reading, and the server role otherwise.
+// A client must start by writing the target address, a server must start by reading it.
+type streamConn struct {
+	net.Conn
+	Cipher
+	r    *reader
+	w    *writer
+	salt []byte // request salt: sent by client or received by server
+}
+
+func (c *streamConn) initReader() error {
+	salt := make([]byte, c.SaltSize())
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	aead, err := c.Decrypter(salt)
+	if err != nil {
+		return err
+	}
+	r := newReader(c.Conn, aead)
+
+	isServer := c.w == nil
+	size := 1 + 8 + 2
+	if !isServer {
+		size += len(c.salt)
+	}
+	hdr, err := r.readChunk(size)
+	if err != nil {
+		return err
+	}
+	if isServer && hdr[0] != headerTypeClient || !isServer && hdr[0] != headerTypeServer {
+		return ErrBadHeader
+	}
+	if err := checkTimestamp(hdr[1:9]); err != nil {
+		return err
+	}
+	if !isServer && !bytes.Equal(hdr[9:9+len(c.salt)], c.salt) {
+		return ErrBadHeader
+	}
+	if salts.Check(salt) {
+		return ErrRepeatedSalt
+	}
+
+	b, err := r.readChunk(int(binary.BigEndian.Uint16(hdr[size-2:])))
+	if err != nil {
+		return err
+	}
+	if isServer {
+		// variable-length header: target address, padding length, padding, initial payload
+		tgt := socks.SplitAddr(b)
+		if tgt == nil || len(b) < len(tgt)+2 {
+			return ErrBadHeader
+		}
+		padding := int(binary.BigEndian.Uint16(b[len(tgt):]))
+		payload := b[len(tgt)+2:]
+		if padding > maxPaddingLength || padding > len(payload) {
+			return ErrBadHeader
+		}
+		payload = payload[padding:]
+		n := copy(b[len(tgt):], payload)
+		b = b[:len(tgt)+n]
+		c.salt = salt
+	}
+	r.leftover = b
+	c.r = r
+	return nil
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	if c.r == nil {
+		if err := c.initReader(); err != nil {
+			return 0, err
+		}
+	}
+	return c.r.Read(b)
+}
+
+func (c *streamConn) WriteTo(w io.Writer) (int64, error) {
+	if c.r == nil {
+		if err := c.initReader(); err != nil {
+			return 0, err
+		}
+	}
+	return c.r.WriteTo(w)
+}
+
+// initWriter sets up the writer and returns number of bytes consumed from b.
+func (c *streamConn) initWriter(b []byte) (int, error) {
+	salt := make([]byte, c.SaltSize())
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return 0, err
+	}
+	aead, err := c.Encrypter(salt)
+	if err != nil {
+		return 0, err
+	}
+	w := newWriter(c.Conn, aead)
+	w.salt = salt
+
+	if c.r != nil { // server: response header is sent along with the first chunk
+		w.header = make([]byte, 1+8+len(c.salt)+2)
+		w.header[0] = headerTypeServer
+		putTimestamp(w.header[1:])
+		copy(w.header[9:], c.salt)
+		c.w = w
+		return 0, nil
+	}
+
+	// client: variable-length header carries target address and initial payload
+	tgt := socks.SplitAddr(b)
+	if tgt == nil {
+		return 0, errMissingAddr
+	}
+	payload := b[len(tgt):]
+	padding := 0
+	if len(payload) == 0 {
+		n, err := rand.Int(rand.Reader, big.NewInt(maxPaddingLength))
+		if err != nil {
+			return 0, err
+		}
+		padding = int(n.Int64()) + 1
+	}
+	if max := payloadSizeMask - len(tgt) - 2; len(payload) > max {
+		payload = payload[:max]
+	}
+	vh := make([]byte, len(tgt)+2+padding+len(payload))
+	copy(vh, tgt)
+	binary.BigEndian.PutUint16(vh[len(tgt):], uint16(padding))
+	copy(vh[len(tgt)+2+padding:], payload)
+
+	w.header = make([]byte, 1+8+2)
+	w.header[0] = headerTypeClient
+	putTimestamp(w.header[1:])
+	if err := w.writeHeader(vh); err != nil {
+		return 0, err
+	}
+	c.salt = salt
+	c.w = w
+	return len(tgt) + len(payload), nil
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	if c.w == nil {
+		n, err := c.initWriter(b)
+		if err != nil || n == len(b) {
+			return n, err
+		}
+		nw, err := c.w.Write(b[n:])
+		return n + nw, err
+	}
+	return c.w.Write(b)
+}
+
+func (c *streamConn) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	if c.w == nil && c.r == nil { // client: target address must come first
+		buf := make([]byte, payloadSizeMask)
+		nr, er := r.Read(buf)
+		if nr > 0 {
+			nw, ew := c.Write(buf[:nr])
+			n += int64(nw)
+			if ew != nil {
+				return n, ew
+			}
+		}
+		if er != nil {
+			if er == io.EOF {
+				er = nil
+			}
+			return n, er
+		}
+	}
+	if c.w == nil {
+		if _, err := c.initWriter(nil); err != nil {
+			return 0, err
+		}
+	}
+	nw, err := c.w.ReadFrom(r)
+	return n + nw, err
+}
+
+// NewConn wraps a stream-oriented net.Conn with cipher.
+func NewConn(c net.Conn, ciph Cipher) net.Conn { return &streamConn{Conn: c, Cipher: ciph} }
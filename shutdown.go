@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// shutdown stops the client and server from taking new connections and UDP sessions, and
+// lets active ones finish within grace before closing them.
+func shutdown(grace time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	stop := func(name string, shutdown func(context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := shutdown(ctx); err != nil {
+				log.Printf("%s shutdown: %v", name, err)
+			}
+		}()
+	}
+	if client != nil {
+		stop("client", client.Shutdown)
+	}
+	if server != nil {
+		stop("server", server.Shutdown)
+	}
+	wg.Wait()
+}
@@ -2,6 +2,8 @@
 package socks
 
 import (
+	"bytes"
+	"errors"
 	"io"
 	"net"
 	"strconv"
@@ -168,47 +170,203 @@ func ParseAddr(s string) Addr {
 	return addr
 }
 
-// Handshake fast-tracks SOCKS initialization to get target address to connect.
+// SOCKS authentication methods as defined in RFC 1928 section 3.
+const (
+	MethodNoAuth       = 0
+	MethodUserPass     = 2
+	MethodNoAcceptable = 0xff
+)
+
+// ErrAuthFailed is returned by HandshakeAuth when the client fails to authenticate.
+var ErrAuthFailed = errors.New("SOCKS authentication failed")
+
+// Handshake fast-tracks SOCKS5, SOCKS4 or SOCKS4a initialization to get target address to
+// connect. SOCKS4 failures are all replied with 0x5b, request rejected or failed: the user ID
+// is not checked with identd, so the identd failures 0x5c and 0x5d are never replied.
 func Handshake(rw io.ReadWriter) (Addr, error) {
+	addr, _, err := HandshakeAuth(rw, nil)
+	return addr, err
+}
+
+// HandshakeAuth is like Handshake but requires RFC 1929 username/password authentication
+// checked by auth, unless auth is nil. Returns the authenticated user name. SOCKS4 clients
+// are rejected when authentication is required.
+func HandshakeAuth(rw io.ReadWriter, auth func(user, password string) bool) (Addr, string, error) {
+	r, err := ReadRequest(rw, auth)
+	if err != nil {
+		return nil, "", err
+	}
+	switch r.Cmd {
+	case CmdBind:
+		r.Reply(rw, ErrCommandNotSupported, nil)
+		return nil, "", ErrCommandNotSupported
+	case CmdUDPAssociate:
+		if err := r.Reply(rw, nil, ParseAddr(rw.(net.Conn).LocalAddr().String())); err != nil {
+			return nil, "", err
+		}
+		return r.Addr, r.User, InfoUDPAssociate
+	}
+	return r.Addr, r.User, r.Reply(rw, nil, nil)
+}
+
+// Request is a SOCKS request read by ReadRequest.
+type Request struct {
+	Version byte // 4 or 5
+	Cmd     byte
+	Addr    Addr
+	User    string // authenticated user name, if any
+}
+
+// ReadRequest performs the SOCKS5, SOCKS4 or SOCKS4a handshake up to the request and returns
+// it, leaving the reply to the caller once it knows the outcome. Connect, SOCKS5 bind and, if
+// UDPEnabled, SOCKS5 UDP associate requests are returned. Others, and unsupported address
+// types, are replied with a failure. Authentication is as in HandshakeAuth.
+func ReadRequest(rw io.ReadWriter, auth func(user, password string) bool) (*Request, error) {
 	// Read RFC 1928 for request and reply structure and sizes.
 	buf := make([]byte, MaxAddrLen)
-	// read VER, NMETHODS, METHODS
-	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+	// read VER
+	if _, err := io.ReadFull(rw, buf[:1]); err != nil {
+		return nil, err
+	}
+	switch buf[0] {
+	case 4:
+		r, err := readRequest4(rw)
+		if err != nil {
+			return nil, err
+		}
+		if auth != nil {
+			r.Reply(rw, ErrConnectionNotAllowed, nil)
+			return nil, ErrAuthFailed
+		}
+		if err := r.check(rw); err != nil {
+			return nil, err
+		}
+		return r, nil
+	case 5:
+	default:
+		return nil, errors.New("unsupported SOCKS version")
+	}
+	// read NMETHODS, METHODS
+	if _, err := io.ReadFull(rw, buf[:1]); err != nil {
 		return nil, err
 	}
-	nmethods := buf[1]
+	nmethods := buf[0]
 	if _, err := io.ReadFull(rw, buf[:nmethods]); err != nil {
 		return nil, err
 	}
+	method := byte(MethodNoAuth)
+	if auth != nil {
+		method = MethodUserPass
+	}
+	if bytes.IndexByte(buf[:nmethods], method) < 0 {
+		rw.Write([]byte{5, MethodNoAcceptable})
+		return nil, ErrAuthFailed
+	}
 	// write VER METHOD
-	if _, err := rw.Write([]byte{5, 0}); err != nil {
+	if _, err := rw.Write([]byte{5, method}); err != nil {
 		return nil, err
 	}
+	r := &Request{Version: 5}
+	if auth != nil {
+		var err error
+		if r.User, err = authUserPass(rw, auth); err != nil {
+			return nil, err
+		}
+	}
 	// read VER CMD RSV ATYP DST.ADDR DST.PORT
 	if _, err := io.ReadFull(rw, buf[:3]); err != nil {
 		return nil, err
 	}
-	cmd := buf[1]
+	r.Cmd = buf[1]
 	addr, err := readAddr(rw, buf)
 	if err != nil {
+		if err == ErrAddressNotSupported {
+			r.Reply(rw, err, nil)
+		}
 		return nil, err
 	}
-	switch cmd {
+	r.Addr = addr
+	if err := r.check(rw); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// check replies with a failure to r if its command is not supported.
+func (r *Request) check(w io.Writer) error {
+	switch r.Cmd {
 	case CmdConnect:
-		_, err = rw.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}) // SOCKS v5, reply succeeded
+		return nil
+	case CmdBind:
+		if r.Version == 5 {
+			return nil
+		}
 	case CmdUDPAssociate:
-		if !UDPEnabled {
-			return nil, ErrCommandNotSupported
+		if UDPEnabled && r.Version == 5 {
+			return nil
 		}
-		listenAddr := ParseAddr(rw.(net.Conn).LocalAddr().String())
-		_, err = rw.Write(append([]byte{5, 0, 0}, listenAddr...)) // SOCKS v5, reply succeeded
+	}
+	r.Reply(w, ErrCommandNotSupported, nil)
+	return ErrCommandNotSupported
+}
+
+// Reply writes a reply to r to w: success with the address bound to serve it if err is nil,
+// otherwise the failure err if an Error, or ErrGeneralFailure. The bound address is 0.0.0.0:0
+// if nil. SOCKS4 replies only tell success from failure, 0x5b. Bind requests are replied twice:
+// with the listening address, then with the address of the connecting peer.
+func (r *Request) Reply(w io.Writer, err error, bound Addr) error {
+	if r.Version == 4 {
+		// write VN CD DSTPORT DSTIP, where only CD matters
+		reply := []byte{0, socks4Granted, 0, 0, 0, 0, 0, 0}
 		if err != nil {
-			return nil, ErrCommandNotSupported
+			reply[1] = socks4Rejected
+		}
+		_, err = w.Write(reply)
+		return err
+	}
+	rep := byte(0) // succeeded
+	if err != nil {
+		rep = byte(ErrGeneralFailure)
+		if e, ok := err.(Error); ok {
+			rep = byte(e)
 		}
-		err = InfoUDPAssociate
-	default:
-		return nil, ErrCommandNotSupported
 	}
+	if bound == nil {
+		bound = Addr{AtypIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	// write VER REP RSV ATYP BND.ADDR BND.PORT
+	_, err = w.Write(append([]byte{5, rep, 0}, bound...))
+	return err
+}
 
-	return addr, err // skip VER, CMD, RSV fields
+// authUserPass performs the RFC 1929 username/password sub-negotiation.
+func authUserPass(rw io.ReadWriter, auth func(user, password string) bool) (string, error) {
+	// read VER ULEN UNAME PLEN PASSWD
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != 1 {
+		return "", ErrAuthFailed
+	}
+	ulen := buf[1]
+	if _, err := io.ReadFull(rw, buf[:ulen]); err != nil {
+		return "", err
+	}
+	user := string(buf[:ulen])
+	if _, err := io.ReadFull(rw, buf[:1]); err != nil {
+		return "", err
+	}
+	plen := buf[0]
+	if _, err := io.ReadFull(rw, buf[:plen]); err != nil {
+		return "", err
+	}
+	if !auth(user, string(buf[:plen])) {
+		rw.Write([]byte{1, 1}) // failure
+		return "", ErrAuthFailed
+	}
+	if _, err := rw.Write([]byte{1, 0}); err != nil { // success
+		return "", err
+	}
+	return user, nil
 }
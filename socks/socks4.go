@@ -0,0 +1,64 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// SOCKS4 reply codes.
+const (
+	socks4Granted  = 0x5a // request granted
+	socks4Rejected = 0x5b // request rejected or failed
+)
+
+// readRequest4 reads a SOCKS4 request after VN.
+func readRequest4(r io.Reader) (*Request, error) {
+	// read CD DSTPORT DSTIP
+	buf := make([]byte, 7)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	cmd, port, ip := buf[0], buf[1:3], buf[3:7]
+
+	// USERID and, for SOCKS4a, the host name end with NUL
+	if _, err := readString(r); err != nil {
+		return nil, err
+	}
+	var addr Addr
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 { // SOCKS4a
+		host, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		addr = make(Addr, 1+1+len(host)+2)
+		addr[0], addr[1] = AtypDomainName, byte(len(host))
+		copy(addr[2:], host)
+		copy(addr[2+len(host):], port)
+	} else {
+		addr = make(Addr, 1+net.IPv4len+2)
+		addr[0] = AtypIPv4
+		copy(addr[1:], ip)
+		copy(addr[1+net.IPv4len:], port)
+	}
+	return &Request{Version: 4, Cmd: cmd, Addr: addr}, nil
+}
+
+// readString reads a NUL-terminated string of at most 255 bytes, one byte at a time so that
+// nothing past it is consumed.
+func readString(r io.Reader) (string, error) {
+	var s []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		if len(s) == 255 {
+			return "", errors.New("socks4: string too long")
+		}
+		s = append(s, b[0])
+	}
+}
@@ -0,0 +1,118 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// handshake runs handshake on the server side of a pipe after the client writes req, and
+// returns the reply.
+func handshake(t *testing.T, req []byte, handshake func(io.ReadWriter) (Addr, error)) ([]byte, Addr, error) {
+	c, s := net.Pipe()
+	defer c.Close()
+	type result struct {
+		addr Addr
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		addr, err := handshake(s)
+		s.Close()
+		done <- result{addr, err}
+	}()
+	go c.Write(req)
+	reply, _ := io.ReadAll(c)
+	r := <-done
+	return reply, r.addr, r.err
+}
+
+func TestHandshakeAuth(t *testing.T) {
+	auth := func(rw io.ReadWriter) (Addr, error) {
+		addr, user, err := HandshakeAuth(rw, func(user, password string) bool {
+			return user == "alice" && password == "secret"
+		})
+		if err == nil && user != "alice" {
+			t.Errorf("user: got %q, want alice", user)
+		}
+		return addr, err
+	}
+	connect := []byte{5, CmdConnect, 0, AtypIPv4, 127, 0, 0, 1, 0, 80}
+	userPass := func(user, password string) []byte {
+		b := append([]byte{1, byte(len(user))}, user...)
+		return append(append(b, byte(len(password))), password...)
+	}
+
+	req := append(append([]byte{5, 2, MethodNoAuth, MethodUserPass}, userPass("alice", "secret")...), connect...)
+	reply, addr, err := handshake(t, req, auth)
+	if err != nil || addr.String() != "127.0.0.1:80" {
+		t.Fatalf("got %v, %v", addr, err)
+	}
+	if want := []byte{5, MethodUserPass, 1, 0}; !bytes.HasPrefix(reply, want) {
+		t.Errorf("reply: got %v, want prefix %v", reply, want)
+	}
+
+	req = append([]byte{5, 2, MethodNoAuth, MethodUserPass}, userPass("alice", "wrong")...)
+	reply, _, err = handshake(t, req, auth)
+	if err != ErrAuthFailed || !bytes.Equal(reply, []byte{5, MethodUserPass, 1, 1}) {
+		t.Errorf("wrong password: got %v, %v", reply, err)
+	}
+
+	reply, _, err = handshake(t, []byte{5, 1, MethodNoAuth}, auth)
+	if err != ErrAuthFailed || !bytes.Equal(reply, []byte{5, MethodNoAcceptable}) {
+		t.Errorf("no acceptable method: got %v, %v", reply, err)
+	}
+}
+
+func TestHandshake4(t *testing.T) {
+	granted := []byte{0, 0x5a, 0, 0, 0, 0, 0, 0}
+
+	// SOCKS4 with user ID
+	reply, addr, err := handshake(t, []byte{4, CmdConnect, 0, 80, 10, 0, 0, 1, 'b', 'o', 'b', 0}, Handshake)
+	if err != nil || addr.String() != "10.0.0.1:80" || !bytes.Equal(reply, granted) {
+		t.Errorf("SOCKS4: got %v, %v, %v", reply, addr, err)
+	}
+
+	// SOCKS4a with host name after the empty user ID
+	req := append([]byte{4, CmdConnect, 1, 187, 0, 0, 0, 1, 0}, "example.com\x00"...)
+	reply, addr, err = handshake(t, req, Handshake)
+	if err != nil || addr.String() != "example.com:443" || !bytes.Equal(reply, granted) {
+		t.Errorf("SOCKS4a: got %v, %v, %v", reply, addr, err)
+	}
+
+	reply, _, err = handshake(t, []byte{4, CmdBind, 0, 80, 10, 0, 0, 1, 0}, Handshake)
+	if err != ErrCommandNotSupported || !bytes.Equal(reply, []byte{0, 0x5b, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("SOCKS4 BIND: got %v, %v", reply, err)
+	}
+}
+
+func TestReplyFailure(t *testing.T) {
+	hello := []byte{5, 1, MethodNoAuth}
+	reply, _, err := handshake(t, append(hello, 5, CmdBind, 0, AtypIPv4, 127, 0, 0, 1, 0, 80), Handshake)
+	if err != ErrCommandNotSupported || !bytes.Equal(reply, []byte{5, 0, 5, 7, 0, 1, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("BIND: got %v, %v", reply, err)
+	}
+	reply, _, err = handshake(t, append(hello, 5, CmdConnect, 0, 2), Handshake)
+	if err != ErrAddressNotSupported || !bytes.Equal(reply, []byte{5, 0, 5, 8, 0, 1, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("unknown address type: got %v, %v", reply, err)
+	}
+
+	// deferred reply with the bound address
+	var r *Request
+	reply, _, err = handshake(t, append(hello, 5, CmdConnect, 0, AtypIPv4, 127, 0, 0, 1, 0, 80), func(rw io.ReadWriter) (Addr, error) {
+		var err error
+		if r, err = ReadRequest(rw, nil); err != nil {
+			return nil, err
+		}
+		return r.Addr, r.Reply(rw, nil, ParseAddr("10.0.0.2:4321"))
+	})
+	if err != nil || !bytes.Equal(reply, []byte{5, 0, 5, 0, 0, 1, 10, 0, 0, 2, 0x10, 0xe1}) {
+		t.Errorf("deferred reply: got %v, %v", reply, err)
+	}
+	var b bytes.Buffer
+	r.Reply(&b, ErrConnectionRefused, nil)
+	if !bytes.Equal(b.Bytes(), []byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("refused: got %v", b.Bytes())
+	}
+}
@@ -1,24 +1,30 @@
 package main
 
 import (
+	"errors"
+	"io"
 	"net"
 
 	"github.com/shadowsocks/go-shadowsocks2/pfutil"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
-func redirLocal(addr, server string, shadow func(net.Conn) net.Conn) {
-	tcpLocal(addr, server, shadow, natLookup)
+func redirLocal(addr string) (io.Closer, error) {
+	return listen(addr, func(l net.Listener) error { return client.ServeRedirect(l, natLookup) })
 }
 
-func redir6Local(addr, server string, shadow func(net.Conn) net.Conn) {
-	panic("TCP6 redirect not supported")
+func redir6Local(addr string) (io.Closer, error) {
+	return nil, errors.New("TCP6 redirect not supported")
 }
 
 func natLookup(c net.Conn) (socks.Addr, error) {
 	if tc, ok := c.(*net.TCPConn); ok {
 		addr, err := pfutil.NatLookup(tc)
-		return socks.ParseAddr(addr.String()), err
+		return realTarget(socks.ParseAddr(addr.String())), err
 	}
 	panic("not TCP connection")
 }
+
+func tproxyLocal(addr string) (io.Closer, error) {
+	return nil, errors.New("TCP TPROXY redirect not supported")
+}
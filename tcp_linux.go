@@ -1,28 +1,52 @@
 package main
 
 import (
+	"errors"
+	"io"
 	"net"
 
 	"github.com/shadowsocks/go-shadowsocks2/nfutil"
+	"github.com/shadowsocks/go-shadowsocks2/service"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
 func getOrigDst(c net.Conn, ipv6 bool) (socks.Addr, error) {
 	if tc, ok := c.(*net.TCPConn); ok {
 		addr, err := nfutil.GetOrigDst(tc, ipv6)
-		return socks.ParseAddr(addr.String()), err
+		return realTarget(socks.ParseAddr(addr.String())), err
 	}
 	panic("not a TCP connection")
 }
 
 // Listen on addr for netfilter redirected TCP connections
-func redirLocal(addr, server string, shadow func(net.Conn) net.Conn) {
-	logf("TCP redirect %s <-> %s", addr, server)
-	tcpLocal(addr, server, shadow, func(c net.Conn) (socks.Addr, error) { return getOrigDst(c, false) })
+func redirLocal(addr string) (io.Closer, error) {
+	logf("TCP redirect %s", addr)
+	origDst := func(c net.Conn) (socks.Addr, error) { return getOrigDst(c, false) }
+	return listen(addr, func(l net.Listener) error { return client.ServeRedirect(l, origDst) })
 }
 
 // Listen on addr for netfilter redirected TCP IPv6 connections.
-func redir6Local(addr, server string, shadow func(net.Conn) net.Conn) {
-	logf("TCP6 redirect %s <-> %s", addr, server)
-	tcpLocal(addr, server, shadow, func(c net.Conn) (socks.Addr, error) { return getOrigDst(c, true) })
+func redir6Local(addr string) (io.Closer, error) {
+	logf("TCP6 redirect %s", addr)
+	origDst := func(c net.Conn) (socks.Addr, error) { return getOrigDst(c, true) }
+	return listen(addr, func(l net.Listener) error { return client.ServeRedirect(l, origDst) })
+}
+
+// Listen on addr for TCP and TCP IPv6 connections redirected by TPROXY, whose local address is
+// the original destination.
+func tproxyLocal(addr string) (io.Closer, error) {
+	l, err := nfutil.ListenTProxyTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+	logf("TCP TPROXY redirect %s", addr)
+	localAddr := func(c net.Conn) (socks.Addr, error) {
+		return realTarget(socks.ParseAddr(c.LocalAddr().String())), nil
+	}
+	go func() {
+		if err := client.ServeRedirect(l, localAddr); !errors.Is(err, net.ErrClosed) && err != service.ErrServerClosed {
+			logf("serve %s: %v", addr, err)
+		}
+	}()
+	return l, nil
 }
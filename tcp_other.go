@@ -3,13 +3,18 @@
 package main
 
 import (
-	"net"
+	"errors"
+	"io"
 )
 
-func redirLocal(addr, server string, shadow func(net.Conn) net.Conn) {
-	logf("TCP redirect not supported")
+func redirLocal(addr string) (io.Closer, error) {
+	return nil, errors.New("TCP redirect not supported")
 }
 
-func redir6Local(addr, server string, shadow func(net.Conn) net.Conn) {
-	logf("TCP6 redirect not supported")
+func redir6Local(addr string) (io.Closer, error) {
+	return nil, errors.New("TCP6 redirect not supported")
+}
+
+func tproxyLocal(addr string) (io.Closer, error) {
+	return nil, errors.New("TCP TPROXY redirect not supported")
 }
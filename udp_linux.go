@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/nfutil"
+	"github.com/shadowsocks/go-shadowsocks2/service"
+)
+
+// tproxyConn receives UDP packets redirected by TPROXY and replies from their original
+// destination through a transparent socket per remote address.
+type tproxyConn struct {
+	*net.UDPConn
+	mu      sync.Mutex
+	senders map[string]*sender
+}
+
+type sender struct {
+	c    *net.UDPConn
+	used time.Time
+}
+
+func (c *tproxyConn) ReadFromOrig(b []byte) (int, net.Addr, net.Addr, error) {
+	n, addr, orig, err := nfutil.ReadFromUDPOrigDst(c.UDPConn, b)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return n, addr, orig, nil
+}
+
+func (c *tproxyConn) WriteToFrom(b []byte, addr, src net.Addr) (int, error) {
+	s, err := c.sender(src)
+	if err != nil {
+		return 0, err
+	}
+	return s.WriteTo(b, addr)
+}
+
+// sender returns the socket sending from src, closing those idle for the UDP timeout.
+func (c *tproxyConn) sender(src net.Addr) (*net.UDPConn, error) {
+	ua, ok := src.(*net.UDPAddr)
+	if !ok {
+		return nil, errors.New("not a UDP address")
+	}
+	key := ua.String()
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.senders == nil {
+		return nil, net.ErrClosed
+	}
+	if s := c.senders[key]; s != nil {
+		s.used = now
+		return s.c, nil
+	}
+	for k, s := range c.senders {
+		if now.Sub(s.used) > config.UDPTimeout {
+			s.c.Close()
+			delete(c.senders, k)
+		}
+	}
+	sc, err := nfutil.ListenTransparentUDP(ua)
+	if err != nil {
+		return nil, err
+	}
+	c.senders[key] = &sender{c: sc, used: now}
+	return sc, nil
+}
+
+func (c *tproxyConn) Close() error {
+	c.mu.Lock()
+	for _, s := range c.senders {
+		s.c.Close()
+	}
+	c.senders = nil
+	c.mu.Unlock()
+	return c.UDPConn.Close()
+}
+
+// Listen on addr for UDP packets redirected by TPROXY.
+func redirUDPLocal(addr string) (io.Closer, error) {
+	uc, err := nfutil.ListenTProxyUDP(addr)
+	if err != nil {
+		return nil, err
+	}
+	logf("UDP redirect %s", addr)
+	c := &tproxyConn{UDPConn: uc, senders: make(map[string]*sender)}
+	go func() {
+		if err := client.ServePacketRedir(c, realTarget); !errors.Is(err, net.ErrClosed) && err != service.ErrServerClosed {
+			logf("serve %s: %v", addr, err)
+		}
+	}()
+	return c, nil
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func redirUDPLocal(addr string) (io.Closer, error) {
+	return nil, errors.New("UDP redirect not supported")
+}